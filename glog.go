@@ -14,7 +14,7 @@
 //
 // Package lg implements logging analogous to the Google-internal C++ INFO/ERROR/V setup.
 // It provides functions Info, Warning, Error, Fatal, plus formatting variants such as
-// Infof. It also provides V-style logging controlled by the -v and -vmodule=file=2 flags.
+// Infof, and Debug, Notice and Critical for finer grained severities. It also provides V-style logging controlled by the -v and -vmodule=file=2 flags.
 //
 // Basic examples:
 //
@@ -35,12 +35,14 @@ package lg // import "github.com/thomasf/lg"
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
 	stdLog "log"
 	"os"
+	"path"
 	"path/filepath"
 	"runtime"
 	"strconv"
@@ -54,30 +56,41 @@ import (
 
 // severity identifies the sort of log: info, warning etc. It also implements
 // the flag.Value interface. The -stderrthreshold flag is of type severity and
-// should be modified only through the flag.Value interface. The values match
-// the corresponding constants in C++.
+// should be modified only through the flag.Value interface. The flag accepts
+// severity names and, for compatibility, the numeric values of the INFO,
+// WARNING, ERROR and FATAL constants in C++.
 type severity int32 // sync/atomic int32
 
 // These constants identify the log levels in order of increasing severity.
 // A message written to a high-severity log file is also written to each
 // lower-severity log file.
 const (
-	infoLog severity = iota
+	debugLog severity = iota
+	infoLog
+	noticeLog
 	warningLog
 	errorLog
+	criticalLog
 	fatalLog
-	numSeverity = 4
+	numSeverity = 7
 )
 
-const severityChar = "IWEF"
+const severityChar = "DINWECF"
 
 var severityName = []string{
-	infoLog:    "INFO",
-	warningLog: "WARNING",
-	errorLog:   "ERROR",
-	fatalLog:   "FATAL",
+	debugLog:    "DEBUG",
+	infoLog:     "INFO",
+	noticeLog:   "NOTICE",
+	warningLog:  "WARNING",
+	errorLog:    "ERROR",
+	criticalLog: "CRITICAL",
+	fatalLog:    "FATAL",
 }
 
+// cppSeverity maps the numeric values of the C++ severity constants to
+// severities.
+var cppSeverity = []severity{infoLog, warningLog, errorLog, fatalLog}
+
 // get returns the value of the severity.
 func (s *severity) get() severity {
 	return severity(atomic.LoadInt32((*int32)(s)))
@@ -90,6 +103,9 @@ func (s *severity) set(val severity) {
 
 // String is part of the flag.Value interface.
 func (s *severity) String() string {
+	if v := s.get(); v >= 0 && v < numSeverity {
+		return severityName[v]
+	}
 	return strconv.FormatInt(int64(*s), 10)
 }
 
@@ -109,9 +125,12 @@ func (s *severity) Set(value string) error {
 		if err != nil {
 			return err
 		}
-		threshold = severity(v)
+		if v < 0 || v >= len(cppSeverity) {
+			return fmt.Errorf("severity %d out of range", v)
+		}
+		threshold = cppSeverity[v]
 	}
-	logging.stderrThreshold.set(threshold)
+	s.set(threshold)
 	return nil
 }
 
@@ -127,8 +146,9 @@ func severityByName(s string) (severity, bool) {
 
 // OutputStats tracks the number of output lines and bytes written.
 type OutputStats struct {
-	lines int64
-	bytes int64
+	lines   int64
+	bytes   int64
+	dropped int64
 }
 
 // Lines returns the number of lines written.
@@ -141,22 +161,42 @@ func (s *OutputStats) Bytes() int64 {
 	return atomic.LoadInt64(&s.bytes)
 }
 
+// Dropped returns the number of lines dropped because the -log_async queue
+// was full or, with -log_error_policy=drop, because the log files could not
+// be written.
+func (s *OutputStats) Dropped() int64 {
+	return atomic.LoadInt64(&s.dropped)
+}
+
+// add counts a line of n bytes as written.
+func (s *OutputStats) add(n int) {
+	atomic.AddInt64(&s.lines, 1)
+	atomic.AddInt64(&s.bytes, int64(n))
+}
+
 // Stats tracks the number of lines of output and number of bytes
 // per severity level. Values must be read with atomic.LoadInt64.
 var Stats struct {
-	Info, Warning, Error OutputStats
+	Debug, Info, Notice, Warning, Error, Critical OutputStats
+	// FileErrors is the number of errors creating or writing log files.
+	FileErrors int64
+	// SinkErrors is the number of errors returned by sinks, see AddSink.
+	SinkErrors int64
 }
 
 var severityStats = [numSeverity]*OutputStats{
-	infoLog:    &Stats.Info,
-	warningLog: &Stats.Warning,
-	errorLog:   &Stats.Error,
+	debugLog:    &Stats.Debug,
+	infoLog:     &Stats.Info,
+	noticeLog:   &Stats.Notice,
+	warningLog:  &Stats.Warning,
+	errorLog:    &Stats.Error,
+	criticalLog: &Stats.Critical,
 }
 
 // Level is exported because it appears in the arguments to V and is
 // the type of the v flag, which can be set programmatically.
 // It's a distinct type because we want to discriminate it from logType.
-// Variables of type level are only changed under logging.mu.
+// Variables of type level are only changed under logging.vmu.
 // The -v flag is read only with atomic ops, so the state of the logging
 // module is consistent.
 
@@ -193,8 +233,8 @@ func (l *Level) Set(value string) error {
 	if err != nil {
 		return err
 	}
-	logging.mu.Lock()
-	defer logging.mu.Unlock()
+	logging.vmu.Lock()
+	defer logging.vmu.Unlock()
 	logging.setVState(Level(v), logging.vmodule.filter, false)
 	return nil
 }
@@ -208,10 +248,20 @@ type moduleSpec struct {
 // It holds a verbosity level and a file pattern to match.
 type modulePat struct {
 	pattern string
-	literal bool // The pattern is a literal string
+	literal bool     // The pattern is a literal string
+	elems   []string // The slash separated elements of a path pattern, nil for a file pattern
 	level   Level
 }
 
+// newModulePat returns the filter for pattern at level.
+func newModulePat(pattern string, level Level) modulePat {
+	m := modulePat{pattern: pattern, literal: isLiteral(pattern), level: level}
+	if strings.Contains(pattern, "/") {
+		m.elems = strings.Split(pattern, "/")
+	}
+	return m
+}
+
 // match reports whether the file matches the pattern. It uses a string
 // comparison if the pattern contains no metacharacters.
 func (m *modulePat) match(file string) bool {
@@ -222,10 +272,43 @@ func (m *modulePat) match(file string) bool {
 	return match
 }
 
+// matchPath reports whether the slash separated path matches the pattern.
+// It is used instead of match for patterns containing a slash.
+func (m *modulePat) matchPath(name string) bool {
+	if m.literal {
+		return name == m.pattern
+	}
+	return matchElems(m.elems, strings.Split(name, "/"))
+}
+
+// matchElems reports whether the path elements in name match those of pattern.
+// Each element is matched using path.Match, except for ** which matches any
+// number of elements, including none.
+func matchElems(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := len(name); i >= 0; i-- {
+				if matchElems(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if match, _ := path.Match(pattern[0], name[0]); !match {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
 func (m *moduleSpec) String() string {
 	// Lock because the type is not atomic. TODO: clean this up.
-	logging.mu.Lock()
-	defer logging.mu.Unlock()
+	logging.vmu.RLock()
+	defer logging.vmu.RUnlock()
 	var b bytes.Buffer
 	for i, f := range m.filter {
 		if i > 0 {
@@ -244,8 +327,20 @@ func (m *moduleSpec) Get() interface{} {
 
 var errVmoduleSyntax = errors.New("syntax error: expect comma-separated list of filename=N")
 
-// Syntax: -vmodule=recordio=2,file=1,gfs*=3
+// Syntax: -vmodule=recordio=2,file=1,gfs*=3,github.com/acme/x/rpc/*=2,github.com/acme/**=1
 func (m *moduleSpec) Set(value string) error {
+	filter, err := parseVmodule(value)
+	if err != nil {
+		return err
+	}
+	logging.vmu.Lock()
+	defer logging.vmu.Unlock()
+	logging.setVState(logging.verbosity, filter, true)
+	return nil
+}
+
+// parseVmodule parses the value of a -vmodule flag.
+func parseVmodule(value string) ([]modulePat, error) {
 	var filter []modulePat
 	for _, pat := range strings.Split(value, ",") {
 		if len(pat) == 0 {
@@ -254,26 +349,23 @@ func (m *moduleSpec) Set(value string) error {
 		}
 		patLev := strings.Split(pat, "=")
 		if len(patLev) != 2 || len(patLev[0]) == 0 || len(patLev[1]) == 0 {
-			return errVmoduleSyntax
+			return nil, errVmoduleSyntax
 		}
 		pattern := patLev[0]
 		v, err := strconv.Atoi(patLev[1])
 		if err != nil {
-			return errors.New("syntax error: expect comma-separated list of filename=N")
+			return nil, errors.New("syntax error: expect comma-separated list of filename=N")
 		}
 		if v < 0 {
-			return errors.New("negative value for vmodule level")
+			return nil, errors.New("negative value for vmodule level")
 		}
 		if v == 0 {
 			continue // Ignore. It's harmless but no point in paying the overhead.
 		}
 		// TODO: check syntax of filter?
-		filter = append(filter, modulePat{pattern, isLiteral(pattern), Level(v)})
+		filter = append(filter, newModulePat(pattern, Level(v)))
 	}
-	logging.mu.Lock()
-	defer logging.mu.Unlock()
-	logging.setVState(logging.verbosity, filter, true)
-	return nil
+	return filter, nil
 }
 
 // isLiteral reports whether the pattern is a literal string, that is, has no metacharacters
@@ -283,35 +375,94 @@ func isLiteral(pattern string) bool {
 }
 
 // traceLocation represents the setting of the -log_backtrace_at flag.
+// It holds any number of file:line locations and function names. It has its
+// own lock so that it can be matched before logging.mu is taken.
 type traceLocation struct {
-	file string
+	mu   sync.Mutex
+	n    int32 // The number of locations, read atomically without mu.
+	locs []*traceLoc
+}
+
+// traceLoc is a single location of the -log_backtrace_at flag. It also counts
+// the stack traces emitted for it, to honor -log_backtrace_limit and
+// -log_backtrace_interval.
+type traceLoc struct {
+	file string // The basename of the file, empty for a function name
 	line int
+	fn   string // The function name, such as rpc.Serve or github.com/acme/x/rpc.Serve
+
+	hits int       // The number of stack traces emitted
+	last time.Time // The time of the last stack trace emitted
 }
 
 // isSet reports whether the trace location has been specified.
-// logging.mu is held.
 func (t *traceLocation) isSet() bool {
-	return t.line > 0
+	return atomic.LoadInt32(&t.n) > 0
 }
 
-// match reports whether the specified file and line matches the trace location.
-// The argument file name is the full path, not the basename specified in the flag.
-// logging.mu is held.
-func (t *traceLocation) match(file string, line int) bool {
-	if t.line != line {
+// match reports whether the specified call site matches a trace location and
+// its stack trace should be emitted. A successful match counts as a hit.
+// The argument file name may be a path, not the basename specified in the flag.
+// The pc is only used to match function names and may be zero.
+func (t *traceLocation) match(pc uintptr, file string, line int) bool {
+	if !t.isSet() {
 		return false
 	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
 	if i := strings.LastIndex(file, "/"); i >= 0 {
 		file = file[i+1:]
 	}
-	return t.file == file
+	var fn string
+	for _, loc := range t.locs {
+		if loc.fn != "" {
+			if pc == 0 {
+				continue
+			}
+			if fn == "" {
+				fn = lookupCallerLoc(pc).function
+			}
+			if fn != loc.fn && !strings.HasSuffix(fn, "/"+loc.fn) {
+				continue
+			}
+		} else if loc.line != line || loc.file != file {
+			continue
+		}
+		return loc.hit(timeNow())
+	}
+	return false
+}
+
+// hit reports whether a stack trace should be emitted for the location at
+// time now, and if so records it.
+// The mu of its traceLocation is held.
+func (loc *traceLoc) hit(now time.Time) bool {
+	if logging.traceLimit > 0 && loc.hits >= logging.traceLimit {
+		return false
+	}
+	if logging.traceInterval > 0 && loc.hits > 0 && now.Sub(loc.last) < logging.traceInterval {
+		return false
+	}
+	loc.hits++
+	loc.last = now
+	return true
 }
 
 func (t *traceLocation) String() string {
-	// Lock because the type is not atomic. TODO: clean this up.
-	logging.mu.Lock()
-	defer logging.mu.Unlock()
-	return fmt.Sprintf("%s:%d", t.file, t.line)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var b bytes.Buffer
+	for i, loc := range t.locs {
+		if i > 0 {
+			b.WriteRune(',')
+		}
+		if loc.fn != "" {
+			b.WriteString(loc.fn)
+		} else {
+			fmt.Fprintf(&b, "%s:%d", loc.file, loc.line)
+		}
+	}
+	return b.String()
 }
 
 // Get is part of the (Go 1.2) flag.Getter interface. It always returns nil for this flag type since the
@@ -320,35 +471,47 @@ func (t *traceLocation) Get() interface{} {
 	return nil
 }
 
-var errTraceSyntax = errors.New("syntax error: expect file.go:234")
+var errTraceSyntax = errors.New("syntax error: expect comma-separated list of file.go:234 or pkg.Func")
 
-// Syntax: -log_backtrace_at=gopherflakes.go:234
+// Syntax: -log_backtrace_at=gopherflakes.go:234,gopherflakes.go:321,flakes.Eat
 // Note that unlike vmodule the file extension is included here.
+// Entries without a line number are function names, qualified by either the
+// package name or the full import path.
 func (t *traceLocation) Set(value string) error {
-	if value == "" {
-		// Unset.
-		t.line = 0
-		t.file = ""
-	}
-	fields := strings.Split(value, ":")
-	if len(fields) != 2 {
-		return errTraceSyntax
-	}
-	file, line := fields[0], fields[1]
-	if !strings.Contains(file, ".") {
-		return errTraceSyntax
-	}
-	v, err := strconv.Atoi(line)
-	if err != nil {
-		return errTraceSyntax
-	}
-	if v <= 0 {
-		return errors.New("negative or zero value for level")
+	var locs []*traceLoc
+	for _, v := range strings.Split(value, ",") {
+		if len(v) == 0 {
+			// Unset, or a trailing comma.
+			continue
+		}
+		fields := strings.Split(v, ":")
+		if len(fields) == 1 {
+			if !strings.Contains(v, ".") || strings.HasSuffix(v, ".go") {
+				return errTraceSyntax
+			}
+			locs = append(locs, &traceLoc{fn: v})
+			continue
+		}
+		if len(fields) != 2 {
+			return errTraceSyntax
+		}
+		file, line := fields[0], fields[1]
+		if !strings.Contains(file, ".") {
+			return errTraceSyntax
+		}
+		n, err := strconv.Atoi(line)
+		if err != nil {
+			return errTraceSyntax
+		}
+		if n <= 0 {
+			return errors.New("negative or zero value for level")
+		}
+		locs = append(locs, &traceLoc{file: file, line: n})
 	}
-	logging.mu.Lock()
-	defer logging.mu.Unlock()
-	t.line = v
-	t.file = file
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.locs = locs
+	atomic.StoreInt32(&t.n, int32(len(locs)))
 	return nil
 }
 
@@ -367,19 +530,54 @@ func init() {
 
 	flag.Var(&logging.verbosity, "v", "log level for V logs")
 	flag.Var(&logging.stderrThreshold, "stderrthreshold", "logs at or above this threshold go to stderr")
-	flag.Var(&logging.vmodule, "vmodule", "comma-separated list of pattern=N settings for file-filtered logging")
-	flag.Var(&logging.traceLocation, "log_backtrace_at", "when logging hits line file:N, emit a stack trace")
+	flag.Var(&logging.minSeverity, "minloglevel", "logs below this severity are discarded; DEBUG logs are discarded unless it is set to DEBUG")
+	flag.Var(&logging.vmodule, "vmodule", "comma-separated list of pattern=N settings for file-filtered logging, patterns containing a slash match package paths")
+	flag.Var(&logging.traceLocation, "log_backtrace_at", "when logging hits line file:N or function pkg.Func, emit a stack trace")
+	flag.IntVar(&logging.traceLimit, "log_backtrace_limit", 0, "if non-zero, emit at most this many stack traces for each -log_backtrace_at location")
+	flag.DurationVar(&logging.traceInterval, "log_backtrace_interval", 0, "if non-zero, emit at most one stack trace per interval for each -log_backtrace_at location")
 
 	// Default stderrThreshold is ERROR.
 	logging.stderrThreshold = errorLog
+	// DEBUG lines are discarded by default.
+	logging.minSeverity = infoLog
+	// By default only FATAL lines flush the log files immediately, the others
+	// wait for the flushDaemon.
+	logging.flushSeverity = fatalLog
+	logging.flushInterval = flushInterval(30 * time.Second)
 
 	logging.setVState(0, nil, false)
-	go logging.flushDaemon()
+	logging.stopDaemon = make(chan struct{})
+	go logging.flushDaemon(logging.stopDaemon)
+}
+
+// SetMinSeverity makes log lines below the named severity be discarded, as
+// the -minloglevel flag does. Valid names are "DEBUG", "INFO", "NOTICE",
+// "WARNING", "ERROR", "CRITICAL" and "FATAL". The default is "INFO", which
+// discards DEBUG lines. FATAL lines are never discarded.
+func SetMinSeverity(name string) error {
+	return logging.minSeverity.Set(name)
+}
+
+// SetStderr enables or disables writing log lines to standard error, whatever
+// the -logtostderr and -stderrthreshold flags say. It is enabled by default,
+// and meant to be disabled when a sink writes to the same place, such as the
+// systemd journal. After Shutdown lines are written to standard error
+// regardless.
+func SetStderr(enabled bool) {
+	var off uint32
+	if !enabled {
+		off = 1
+	}
+	atomic.StoreUint32(&logging.stderrOff, off)
 }
 
-// Flush flushes all pending log I/O.
+// Flush flushes all pending log I/O, including lines queued by -log_async.
 func Flush() {
+	if q := logging.asyncQueue(); q != nil {
+		q.drain()
+	}
 	logging.lockAndFlushAll()
+	flushSinks()
 }
 
 // loggingT collects all the global state of the logging setup.
@@ -391,9 +589,22 @@ type loggingT struct {
 	color    bool // The -logcolor flag.
 	toMemory bool // the -logtomemory flag
 	toFile   bool // the -logtofile flag
+	fanout   bool // The -log_fanout flag.
+	withFunc bool // The -log_func flag.
 
-	// Level flag. Handled atomically.
+	// Level flags. Handled atomically.
 	stderrThreshold severity // The -stderrthreshold flag.
+	minSeverity     severity // The -minloglevel flag.
+	flushSeverity   severity // The -log_flush_severity flag.
+	// Flush and sync settings. Handled atomically.
+	flushInterval flushInterval // The -log_flush_interval flag.
+	fsync         fsyncPolicy   // The -log_fsync flag.
+	// File error policy. Handled atomically.
+	errorPolicy errorPolicy // The -log_error_policy flag.
+	// Severities with a log file. Handled atomically.
+	files severityFiles // The -log_files flag.
+	// Source file format. Handled atomically.
+	source sourceMode // The -log_source flag.
 
 	// freeList is a list of byte buffers, maintained under freeListMu.
 	freeList *buffer
@@ -402,23 +613,58 @@ type loggingT struct {
 	// for better parallelization.
 	freeListMu sync.Mutex
 
-	// mu protects the remaining elements of this structure and is
-	// used to synchronize logging.
+	// mu protects the remaining elements of this structure, unless stated
+	// otherwise, and is used to synchronize logging.
 	mu sync.Mutex
 	// file holds writer for each of the log types.
 	file [numSeverity]flushSyncWriter
-	// pcs is used in V to avoid an allocation when computing the caller's PC.
-	pcs [1]uintptr
+	// fileErr is the state of the files after an error, and onFileError is
+	// called with each error.
+	fileErr     fileErrorState
+	onFileError func(error)
+
+	// vmu serializes changes to vmap, vmodule and verbosity. It is separate
+	// from the main mutex, and not taken in the common case, so that V calls
+	// neither contend with output nor with each other.
+	vmu sync.RWMutex
 	// vmap is a cache of the V Level for each V() call site, identified by PC.
-	// It is wiped whenever the vmodule flag changes state.
-	vmap map[uintptr]Level
+	// It holds a map[uintptr]Level which is never modified once stored, so
+	// that V reads it without locking; setV stores a copy with the new call
+	// site. It is wiped whenever the vmodule flag changes state.
+	vmap atomic.Value
 	// filterLength stores the length of the vmodule filter chain. If greater
 	// than zero, it means vmodule is enabled. It may be read safely
-	// using sync.LoadInt32, but is only modified under mu.
+	// using sync.LoadInt32, but is only modified under vmu.
 	filterLength int32
+
 	// traceLocation is the state of the -log_backtrace_at flag.
 	traceLocation traceLocation
-	// These flags are modified only under lock, although verbosity may be fetched
+	// traceLimit and traceInterval restrict how often traceLocation emits
+	// stack traces.
+	traceLimit    int           // The -log_backtrace_limit flag.
+	traceInterval time.Duration // The -log_backtrace_interval flag.
+	// dedup holds the last line written, to collapse repeats of it within
+	// dedupWindow.
+	dedup       dedupState
+	dedupWindow time.Duration // The -log_dedup flag.
+	// async is the -log_async queue, created by asyncQueue once.
+	async         *asyncQueue
+	asyncOnce     sync.Once
+	asyncSize     int            // The -log_async flag.
+	asyncOverflow overflowPolicy // The -log_async_overflow flag.
+	// stopDaemon is closed by Shutdown to stop the flushDaemon.
+	stopDaemon   chan struct{}
+	shutdownOnce sync.Once
+	// closed is set by Shutdown, after which only standard error is written.
+	// It is handled atomically.
+	closed uint32
+	// stderrOff is set by SetStderr(false). It is handled atomically.
+	stderrOff uint32
+	// reopenOnHup is the -log_reopen_on_sighup flag, acted upon by createFiles
+	// once.
+	reopenOnHup   bool
+	reopenHupOnce sync.Once
+	// These flags are modified only under vmu, although verbosity may be fetched
 	// safely using atomic.LoadInt32.
 	vmodule   moduleSpec // The state of the -vmodule flag.
 	verbosity Level      // V logging level, the value of the -v flag/
@@ -434,12 +680,28 @@ type buffer struct {
 	bytes.Buffer
 	tmp  [64]byte // temporary byte array for creating headers.
 	next *buffer
+	// The parts of the line which a Record is made of, set by formatHeader
+	// and by the functions writing the message.
+	time        time.Time
+	msg, msgEnd int     // The message is Bytes()[msg:msgEnd]
+	fields      []Field // The fields following the message, if known
+}
+
+// endMessage marks the end of the message, before any fields and the
+// trailing newline, unless it was marked already.
+func (buf *buffer) endMessage() {
+	if buf.msgEnd == 0 {
+		buf.msgEnd = buf.Len()
+		if buf.msgEnd > buf.msg && buf.Bytes()[buf.msgEnd-1] == '\n' {
+			buf.msgEnd--
+		}
+	}
 }
 
 var logging loggingT
 
 // setVState sets a consistent state for V logging.
-// l.mu is held.
+// l.vmu is held.
 func (l *loggingT) setVState(verbosity Level, filter []modulePat, setFilter bool) {
 	// Turn verbosity off so V will not fire while we are in transition.
 	logging.verbosity.set(0)
@@ -449,7 +711,7 @@ func (l *loggingT) setVState(verbosity Level, filter []modulePat, setFilter bool
 	// Set the new filters and wipe the pc->Level map if the filter has changed.
 	if setFilter {
 		logging.vmodule.filter = filter
-		logging.vmap = make(map[uintptr]Level)
+		logging.vmap.Store(map[uintptr]Level{})
 	}
 
 	// Things are consistent now, so enable filtering and verbosity.
@@ -475,12 +737,18 @@ func (l *loggingT) getBuffer() *buffer {
 	return b
 }
 
+// maxBufferSize is the capacity above which buffers are not reused. It is
+// large enough for typical lines, including those with many Event fields, to
+// be formatted without allocating.
+const maxBufferSize = 4 * 1024
+
 // putBuffer returns a buffer to the free list.
 func (l *loggingT) putBuffer(b *buffer) {
-	if b.Len() >= 256 {
+	if b.Cap() > maxBufferSize {
 		// Let big buffers die a natural death.
 		return
 	}
+	b.fields = nil // Sinks may have kept them.
 	l.freeListMu.Lock()
 	b.next = l.freeList
 	l.freeList = b
@@ -489,9 +757,13 @@ func (l *loggingT) putBuffer(b *buffer) {
 
 var timeNow = time.Now // Stubbed out for testing.
 
+// headerPrefixLen is the length of the fixed width part of the log header
+// which precedes the file name.
+const headerPrefixLen = 30
+
 /*
 header formats a log header as defined by the C++ implementation.
-It returns a buffer containing the formatted header and the user's file and line number.
+It returns a buffer containing the formatted header and the user's file, line number and PC.
 The depth specifies how many stack frames above lives the source line to be identified in the log message.
 
 Log lines have this form:
@@ -502,31 +774,28 @@ where the fields are defined as follows:
 	dd               The day (zero padded)
 	hh:mm:ss.uuuuuu  Time in hours, minutes and fractional seconds
 	threadid         The space-padded thread ID as returned by GetTID()
-	file             The file name
+	file             The file name, see the -log_source flag
 	line             The line number
+	func             The function name, only present if -log_func is set
 	msg              The user-supplied message
 */
-func (l *loggingT) header(s severity, depth int) (*buffer, string, int) {
-	_, file, line, ok := runtime.Caller(3 + depth)
-	if !ok {
-		file = "???"
-		line = 1
-	} else {
-		slash := strings.LastIndex(file, "/")
-		if slash >= 0 {
-			file = file[slash+1:]
-		}
+func (l *loggingT) header(s severity, depth int) (*buffer, string, int, uintptr) {
+	loc, pc := caller(3 + depth)
+	if loc == nil {
+		return l.formatHeader(s, "???", 1, ""), "???", 1, 0
 	}
-	return l.formatHeader(s, file, line), file, line
+	file, fn := l.location(loc)
+	return l.formatHeader(s, file, loc.line, fn), file, loc.line, pc
 }
 
-// formatHeader formats a log header using the provided file name and line number.
-func (l *loggingT) formatHeader(s severity, file string, line int) *buffer {
+// formatHeader formats a log header using the provided file name, line number
+// and optional function name.
+func (l *loggingT) formatHeader(s severity, file string, line int, fn string) *buffer {
 	now := timeNow()
 	if line < 0 {
 		line = 0 // not a real line number, but acceptable to someDigits
 	}
-	if s > fatalLog {
+	if s < debugLog || s > fatalLog {
 		s = infoLog // for safety.
 	}
 	buf := l.getBuffer()
@@ -550,13 +819,19 @@ func (l *loggingT) formatHeader(s severity, file string, line int) *buffer {
 	buf.tmp[21] = ' '
 	buf.nDigits(7, 22, pid, ' ') // TODO: should be TID
 	buf.tmp[29] = ' '
-	buf.Write(buf.tmp[:30])
+	buf.Write(buf.tmp[:headerPrefixLen])
 	buf.WriteString(file)
 	buf.tmp[0] = ':'
 	n := buf.someDigits(1, line)
-	buf.tmp[n+1] = ']'
-	buf.tmp[n+2] = ' '
-	buf.Write(buf.tmp[:n+3])
+	buf.Write(buf.tmp[:n+1])
+	if fn != "" {
+		buf.WriteByte(' ')
+		buf.WriteString(fn)
+	}
+	buf.WriteString("] ")
+	buf.time = now
+	buf.msg, buf.msgEnd = buf.Len(), 0
+	buf.fields = nil
 	return buf
 }
 
@@ -602,9 +877,12 @@ func (buf *buffer) someDigits(i, d int) int {
 }
 
 func (l *loggingT) println(s severity, args ...interface{}) {
-	buf, file, line := l.header(s, 0)
+	if l.discards(s) {
+		return
+	}
+	buf, file, line, pc := l.header(s, 0)
 	fmt.Fprintln(buf, args...)
-	l.output(s, buf, file, line, false)
+	l.output(s, buf, pc, file, line, false)
 }
 
 func (l *loggingT) print(s severity, args ...interface{}) {
@@ -612,115 +890,117 @@ func (l *loggingT) print(s severity, args ...interface{}) {
 }
 
 func (l *loggingT) printDepth(s severity, depth int, args ...interface{}) {
-	buf, file, line := l.header(s, depth)
+	if l.discards(s) {
+		return
+	}
+	buf, file, line, pc := l.header(s, depth)
 	fmt.Fprint(buf, args...)
 	if buf.Bytes()[buf.Len()-1] != '\n' {
 		buf.WriteByte('\n')
 	}
-	l.output(s, buf, file, line, false)
+	l.output(s, buf, pc, file, line, false)
 }
 
 func (l *loggingT) printf(s severity, format string, args ...interface{}) {
-	buf, file, line := l.header(s, 0)
+	if l.discards(s) {
+		return
+	}
+	buf, file, line, pc := l.header(s, 0)
 	fmt.Fprintf(buf, format, args...)
 	if buf.Bytes()[buf.Len()-1] != '\n' {
 		buf.WriteByte('\n')
 	}
-	l.output(s, buf, file, line, false)
+	l.output(s, buf, pc, file, line, false)
 }
 
 // printWithFileLine behaves like print but uses the provided file and line number.  If
 // alsoLogToStderr is true, the log message always appears on standard error; it
 // will also appear in the log file unless --logtostderr is set.
 func (l *loggingT) printWithFileLine(s severity, file string, line int, alsoToStderr bool, args ...interface{}) {
-	buf := l.formatHeader(s, file, line)
+	if l.discards(s) {
+		return
+	}
+	buf := l.formatHeader(s, file, line, "")
 	fmt.Fprint(buf, args...)
 	if buf.Bytes()[buf.Len()-1] != '\n' {
 		buf.WriteByte('\n')
 	}
-	l.output(s, buf, file, line, alsoToStderr)
+	l.output(s, buf, 0, file, line, alsoToStderr)
+}
+
+// discards reports whether lines of severity s are discarded because of
+// -minloglevel.
+func (l *loggingT) discards(s severity) bool {
+	return s < l.minSeverity.get()
 }
 
 func printColor(s severity) {
 	switch s {
+	case debugLog:
+		ct.Foreground(ct.White, false)
 	case infoLog:
 		ct.Foreground(ct.Cyan, false)
+	case noticeLog:
+		ct.Foreground(ct.Green, false)
 	case warningLog:
 		ct.Foreground(ct.Yellow, false)
 	case errorLog:
 		ct.Foreground(ct.Red, true)
+	case criticalLog:
+		ct.Foreground(ct.Magenta, true)
 	case fatalLog:
 		ct.Foreground(ct.Red, false)
 	}
 }
 
 // output writes the data to the log files and releases the buffer.
-func (l *loggingT) output(s severity, buf *buffer, file string, line int, alsoToStderr bool) {
-	l.mu.Lock()
-	if l.traceLocation.isSet() {
-		if l.traceLocation.match(file, line) {
-			buf.Write(stacks(false))
+// The pc identifies the call site and may be zero if it is unknown.
+func (l *loggingT) output(s severity, buf *buffer, pc uintptr, file string, line int, alsoToStderr bool) {
+	buf.endMessage()
+	trace := l.traceLocation.match(pc, file, line)
+	if trace {
+		buf.Write(stacks(false))
+	}
+	if flag.Parsed() && atomic.LoadUint32(&l.closed) == 0 {
+		if q := l.asyncQueue(); q != nil {
+			if s != fatalLog {
+				q.enqueue(asyncRecord{s, buf, pc, file, line, alsoToStderr, trace, 0, nil})
+				return
+			}
+			// Write everything logged before the fatal record first.
+			q.drain()
 		}
 	}
+	if s == fatalLog {
+		// l.mu is held until the process exits, so the pending repeat count
+		// is written and the sinks get it and the line first. They are
+		// flushed by timeoutFlush below.
+		l.mu.Lock()
+		l.flushRepeated()
+		repeats := l.takeRepeated()
+		l.mu.Unlock()
+		l.sinkRepeated(repeats)
+		l.toSinks(s, buf, pc, file, line)
+	}
+	l.mu.Lock()
 	data := buf.Bytes()
 	if !flag.Parsed() {
 		os.Stderr.Write([]byte("ERROR: logging before flag.Parse: "))
 		os.Stderr.Write(data)
 	} else {
-		if l.toMemory {
-			logToMemory(data)
-		}
-		if alsoToStderr || l.toStderr || s >= l.stderrThreshold.get() {
-			if !l.color {
-				os.Stderr.Write(data)
-			} else {
-				// color printing is allowed to be inefficient.
-				printColor(s)
-				os.Stderr.Write(data[0:14])
-				ct.ResetColor()
-				os.Stderr.Write(data[14:30])
-				ct.Foreground(ct.Blue, true)
-				n, _ := os.Stderr.Write([]byte(file))
-				ct.ResetColor()
-				os.Stderr.WriteString(":")
-				printColor(s)
-				rest := data[30+n+1:]
-				end := bytes.IndexAny(rest, "]")
-				os.Stderr.Write(rest[:end])
-				ct.Foreground(ct.Blue, true)
-				os.Stderr.WriteString("]")
-				ct.ResetColor()
-				if l.traceLocation.isSet() && l.traceLocation.match(file, line) {
-					outputColorStack(rest[end+1:], s)
-				} else {
-					os.Stderr.Write(rest[end+1:])
-				}
-			}
-		}
-		if l.toFile {
-			if l.file[s] == nil {
-				if err := l.createFiles(s); err != nil {
-					os.Stderr.Write(data) // Make sure the message appears somewhere.
-					l.exit(err)
-				}
-			}
-			switch s {
-			case fatalLog:
-				l.file[fatalLog].Write(data)
-				fallthrough
-			case errorLog:
-				l.file[errorLog].Write(data)
-				fallthrough
-			case warningLog:
-				l.file[warningLog].Write(data)
-				fallthrough
-			case infoLog:
-				l.file[infoLog].Write(data)
-			}
+		if s != fatalLog && l.repeated(s, data, file, line) {
+			l.putBuffer(buf)
+			l.mu.Unlock()
+			return
 		}
-
+		l.write(s, data, file, alsoToStderr, trace)
 	}
 	if s == fatalLog {
+		// The process exits below, so the memory log cannot wait for l.mu
+		// to be released.
+		if l.toMemory && flag.Parsed() {
+			logToMemory(data)
+		}
 		// If we got here via Exit rather than Fatal, print no stacks.
 		if atomic.LoadUint32(&fatalNoStacks) > 0 {
 			l.mu.Unlock()
@@ -752,7 +1032,7 @@ func (l *loggingT) output(s severity, buf *buffer, file string, line int, alsoTo
 		}
 
 		logExitFunc = func(error) {} // If we get a write error, we'll still exit below.
-		for log := fatalLog; log >= infoLog; log-- {
+		for log := fatalLog; log >= debugLog; log-- {
 			if f := l.file[log]; f != nil { // Can be nil if -logtostderr is set.
 				f.Write(trace)
 			}
@@ -761,11 +1041,61 @@ func (l *loggingT) output(s severity, buf *buffer, file string, line int, alsoTo
 		timeoutFlush(10 * time.Second)
 		os.Exit(255) // C++ uses -1, which is silly because it's anded with 255 anyway.
 	}
-	l.putBuffer(buf)
+	repeats := l.takeRepeated()
 	l.mu.Unlock()
+	// The memory log has its own lock.
+	if l.toMemory && flag.Parsed() {
+		logToMemory(data)
+	}
+	l.sinkRepeated(repeats)
+	l.toSinks(s, buf, pc, file, line)
+	l.putBuffer(buf)
 	if stats := severityStats[s]; stats != nil {
-		atomic.AddInt64(&stats.lines, 1)
-		atomic.AddInt64(&stats.bytes, int64(len(data)))
+		stats.add(len(data))
+	}
+}
+
+// write writes the data to standard error and the log files for severity s
+// and below. If trace is set, data ends with a stack trace. Callers write to
+// the memory log themselves, preferably after releasing l.mu.
+// l.mu is held.
+func (l *loggingT) write(s severity, data []byte, file string, alsoToStderr, trace bool) {
+	closed := atomic.LoadUint32(&l.closed) != 0
+	toStderr := closed || atomic.LoadUint32(&l.stderrOff) == 0 &&
+		(alsoToStderr || l.toStderr || s >= l.stderrThreshold.get())
+	if toStderr {
+		if !l.color {
+			os.Stderr.Write(data)
+		} else {
+			// color printing is allowed to be inefficient.
+			// The header prefix up to the file has a fixed length while
+			// the location which follows it does not.
+			printColor(s)
+			os.Stderr.Write(data[0:14])
+			ct.ResetColor()
+			os.Stderr.Write(data[14:headerPrefixLen])
+			ct.Foreground(ct.Blue, true)
+			os.Stderr.WriteString(file)
+			ct.ResetColor()
+			os.Stderr.WriteString(":")
+			printColor(s)
+			rest := data[headerPrefixLen+len(file)+1:]
+			end := bytes.Index(rest, []byte("] "))
+			os.Stderr.Write(rest[:end])
+			ct.Foreground(ct.Blue, true)
+			os.Stderr.WriteString("]")
+			ct.ResetColor()
+			if trace {
+				outputColorStack(rest[end+1:], s)
+			} else {
+				os.Stderr.Write(rest[end+1:])
+			}
+		}
+	}
+	if l.toFile && !closed {
+		if err := l.writeFiles(s, data); err != nil {
+			l.fileFailed(err, s, data, toStderr)
+		}
 	}
 }
 
@@ -877,8 +1207,9 @@ func outputColorStack(stacks []byte, s severity) {
 // would make its use clumsier.
 var logExitFunc func(error)
 
-// exit is called if there is trouble creating or writing log files.
-// It flushes the logs and exits the program; there's no point in hanging around.
+// exit is called if there is trouble creating or writing log files and
+// -log_error_policy is exit. It flushes the logs and exits the program;
+// there's no point in hanging around.
 // l.mu is held.
 func (l *loggingT) exit(err error) {
 	fmt.Fprintf(os.Stderr, "log: exiting because of error: %s\n", err)
@@ -898,53 +1229,90 @@ func (l *loggingT) exit(err error) {
 type syncBuffer struct {
 	logger *loggingT
 	*bufio.Writer
-	file   *os.File
-	sev    severity
-	nbytes uint64 // The number of bytes written to this file
+	file     *os.File
+	sev      severity
+	nbytes   uint64    // The number of bytes written to this file
+	unsynced uint64    // The number of bytes written since the file was last synced
+	rotateAt time.Time // When to rotate the file again after it was kept
+}
+
+// Close closes the file. Buffered data must have been flushed first.
+func (sb *syncBuffer) Close() error {
+	if sb.file == nil {
+		return nil
+	}
+	return sb.file.Close()
 }
 
 func (sb *syncBuffer) Sync() error {
+	sb.unsynced = 0
 	return sb.file.Sync()
 }
 
 func (sb *syncBuffer) Write(p []byte) (n int, err error) {
-	if sb.nbytes+uint64(len(p)) >= MaxSize {
-		if err := sb.rotateFile(time.Now()); err != nil {
-			sb.logger.exit(err)
+	if sb.nbytes+uint64(len(p)) >= MaxSize && !*stableNames {
+		if now := timeNow(); !now.Before(sb.rotateAt) {
+			if err := sb.rotateFile(now); err != nil {
+				return 0, err
+			}
 		}
 	}
 	n, err = sb.Writer.Write(p)
 	sb.nbytes += uint64(n)
+	sb.unsynced += uint64(n)
 	if err != nil {
-		sb.logger.exit(err)
+		return
+	}
+	if policy := sb.logger.fsync.get(); policy > 0 && sb.unsynced >= uint64(policy) {
+		sb.Flush() // ignore error
+		sb.Sync()  // ignore error
 	}
 	return
 }
 
-// rotateFile closes the syncBuffer's file and starts a new one.
+// rotateFile closes the syncBuffer's file and starts a new one. If the new
+// file cannot be created, the old one is kept. So is the old file if the new
+// one would have the same name, as when rotating twice within a second.
 func (sb *syncBuffer) rotateFile(now time.Time) error {
 	if sb.file != nil {
+		// With -log_stable_names the new file may be the old one.
 		sb.Flush()
-		sb.file.Close()
 	}
-	var err error
-	sb.file, _, err = create(severityName[sb.sev], now)
-	sb.nbytes = 0
+	file, fname, err := create(severityName[sb.sev], now)
+	if err, ok := err.(*os.PathError); ok && os.IsExist(err) && sb.file != nil && err.Path == sb.file.Name() {
+		// The name changes with the second at the earliest.
+		sb.rotateAt = now.Truncate(time.Second).Add(time.Second)
+		return nil
+	}
 	if err != nil {
 		return err
 	}
 
-	sb.Writer = bufio.NewWriterSize(sb.file, bufferSize)
-
 	// Write header.
 	var buf bytes.Buffer
 	fmt.Fprintf(&buf, "Log file created at: %s\n", now.Format("2006/01/02 15:04:05"))
 	fmt.Fprintf(&buf, "Running on machine: %s\n", host)
 	fmt.Fprintf(&buf, "Binary: Built with %s %s for %s/%s\n", runtime.Compiler, runtime.Version(), runtime.GOOS, runtime.GOARCH)
-	fmt.Fprintf(&buf, "Log line format: [IWEF]mmdd hh:mm:ss.uuuuuu threadid file:line] msg\n")
-	n, err := sb.file.Write(buf.Bytes())
-	sb.nbytes += uint64(n)
-	return err
+	fmt.Fprintf(&buf, "Log line format: [DINWECF]mmdd hh:mm:ss.uuuuuu threadid file:line] msg\n")
+	n, err := file.Write(buf.Bytes())
+	if err != nil {
+		// The disk may be full; do not leave an empty file behind.
+		file.Close()
+		if !*stableNames {
+			os.Remove(fname) // ignore err
+		}
+		return err
+	}
+
+	if sb.file != nil {
+		sb.file.Close()
+	}
+	sb.file = file
+	sb.nbytes = uint64(n)
+	sb.unsynced = 0
+
+	sb.Writer = bufio.NewWriterSize(sb.file, bufferSize)
+	return nil
 }
 
 // bufferSize sizes the buffer associated with each log file. It's large
@@ -952,13 +1320,19 @@ func (sb *syncBuffer) rotateFile(now time.Time) error {
 // on disk I/O. The flushDaemon will block instead.
 const bufferSize = 256 * 1024
 
-// createFiles creates all the log files for severity from sev down to infoLog.
+// createFiles creates all the missing log files selected by -log_files, for
+// severity from sev down to debugLog.
 // l.mu is held.
 func (l *loggingT) createFiles(sev severity) error {
-	now := time.Now()
-	// Files are created in decreasing severity order, so as soon as we find one
-	// has already been created, we can stop.
-	for s := sev; s >= infoLog && l.file[s] == nil; s-- {
+	if l.reopenOnHup {
+		l.reopenHupOnce.Do(func() { ReopenOnSignal() })
+	}
+	now := timeNow()
+	files := l.files.get()
+	for s := sev; s >= debugLog; s-- {
+		if l.file[s] != nil || !files.has(s) {
+			continue
+		}
 		sb := &syncBuffer{
 			logger: l,
 			sev:    s,
@@ -971,31 +1345,112 @@ func (l *loggingT) createFiles(sev severity) error {
 	return nil
 }
 
-const flushInterval = 30 * time.Second
+// flushDaemon periodically flushes the log file buffers, every
+// -log_flush_interval, until stop is closed.
+func (l *loggingT) flushDaemon(stop chan struct{}) {
+	timer := time.NewTimer(l.flushInterval.get())
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			l.lockAndFlushAll()
+		case <-flushIntervalChanged:
+			if !timer.Stop() {
+				<-timer.C
+			}
+		case <-stop:
+			return
+		}
+		timer.Reset(l.flushInterval.get())
+	}
+}
 
-// flushDaemon periodically flushes the log file buffers.
-func (l *loggingT) flushDaemon() {
-	for range time.NewTicker(flushInterval).C {
-		l.lockAndFlushAll()
+// Shutdown stops the flush daemon, writes the lines queued by -log_async,
+// then flushes, syncs and closes all log files, and closes the sinks. Lines logged afterwards are
+// written to standard error only. If ctx is done before all of this is
+// finished, Shutdown returns ctx.Err() and lets the rest proceed in the
+// background. Otherwise it returns the first error encountered, if any.
+// Only the first call to Shutdown has any effect.
+func Shutdown(ctx context.Context) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- logging.shutdown()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
 	}
 }
 
+// shutdown implements Shutdown.
+func (l *loggingT) shutdown() error {
+	var firstErr error
+	l.shutdownOnce.Do(func() {
+		close(l.stopDaemon)
+		if q := l.asyncQueue(); q != nil {
+			q.drain()
+		}
+		l.mu.Lock()
+		l.flushRepeated()
+		repeats := l.takeRepeated()
+		atomic.StoreUint32(&l.closed, 1)
+		for s := fatalLog; s >= debugLog; s-- {
+			file := l.file[s]
+			if file == nil {
+				continue
+			}
+			err := file.Flush()
+			if err == nil {
+				err = file.Sync()
+			}
+			if c, ok := file.(io.Closer); ok {
+				if cerr := c.Close(); err == nil {
+					err = cerr
+				}
+			}
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+			l.file[s] = nil
+		}
+		l.mu.Unlock()
+		l.sinkRepeated(repeats)
+		if err := closeSinks(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	})
+	return firstErr
+}
+
 // lockAndFlushAll is like flushAll but locks l.mu first.
 func (l *loggingT) lockAndFlushAll() {
 	l.mu.Lock()
 	l.flushAll()
+	repeats := l.takeRepeated()
 	l.mu.Unlock()
+	l.sinkRepeated(repeats)
 }
 
-// flushAll flushes all the logs and attempts to "sync" their data to disk.
+// flushAll writes any pending -log_dedup repeat count, flushes all the logs
+// and, unless -log_fsync says otherwise, attempts to "sync" their data to
+// disk.
 // l.mu is held.
 func (l *loggingT) flushAll() {
+	l.flushRepeated()
+	sync := l.fsync.get() == fsyncOnFlush
 	// Flush from fatal down, in case there's trouble flushing.
-	for s := fatalLog; s >= infoLog; s-- {
+	for s := fatalLog; s >= debugLog; s-- {
 		file := l.file[s]
 		if file != nil {
-			file.Flush() // ignore error
-			file.Sync()  // ignore error
+			err := file.Flush()
+			if sync {
+				if serr := file.Sync(); err == nil {
+					err = serr
+				}
+			}
+			l.fileFlushed(err)
 		}
 	}
 }
@@ -1005,8 +1460,8 @@ func (l *loggingT) flushAll() {
 // severities.  Subsequent changes to the standard log's default output location
 // or format may break this behavior.
 //
-// Valid names are "INFO", "WARNING", "ERROR", and "FATAL".  If the name is not
-// recognized, CopyStandardLogTo panics.
+// Valid names are "DEBUG", "INFO", "NOTICE", "WARNING", "ERROR", "CRITICAL"
+// and "FATAL".  If the name is not recognized, CopyStandardLogTo panics.
 func CopyStandardLogTo(name string) {
 	sev, ok := severityByName(name)
 	if !ok {
@@ -1063,27 +1518,56 @@ func (lb logBridge) Write(b []byte) (n int, err error) {
 
 // setV computes and remembers the V level for a given PC
 // when vmodule is enabled.
+// l.vmu is held.
+func (l *loggingT) setV(pc uintptr) Level {
+	old, _ := l.vmap.Load().(map[uintptr]Level)
+	if v, ok := old[pc]; ok {
+		// Another V call added pc while we waited for the lock.
+		return v
+	}
+	v := matchV(l.vmodule.filter, pc)
+	vmap := make(map[uintptr]Level, len(old)+1)
+	for k, kv := range old {
+		vmap[k] = kv
+	}
+	vmap[pc] = v
+	l.vmap.Store(vmap)
+	return v
+}
+
+// matchV returns the V level of the first of filter matching the source of
+// pc, or 0 if none does.
 // File pattern matching takes the basename of the file, stripped
 // of its .go suffix, and uses filepath.Match, which is a little more
 // general than the *? matching used in C++.
-// l.mu is held.
-func (l *loggingT) setV(pc uintptr) Level {
+// Patterns containing a slash are instead matched against the package
+// import path and the directory of the file, either on its own or joined
+// with the basename, so that github.com/acme/x/rpc=2 and
+// github.com/acme/x/rpc/*=2 both match all files of that package.
+func matchV(filters []modulePat, pc uintptr) Level {
 	fn := runtime.FuncForPC(pc)
 	file, _ := fn.FileLine(pc)
 	// The file is something like /a/b/c/d.go. We want just the d.
 	if strings.HasSuffix(file, ".go") {
 		file = file[:len(file)-3]
 	}
+	dir := filepath.ToSlash(filepath.Dir(file))
 	if slash := strings.LastIndex(file, "/"); slash >= 0 {
 		file = file[slash+1:]
 	}
-	for _, filter := range l.vmodule.filter {
-		if filter.match(file) {
-			l.vmap[pc] = filter.level
+	pkg := funcPackage(fn.Name())
+	for _, filter := range filters {
+		var match bool
+		if filter.elems == nil {
+			match = filter.match(file)
+		} else {
+			match = filter.matchPath(pkg) || filter.matchPath(pkg+"/"+file) ||
+				filter.matchPath(dir) || filter.matchPath(dir+"/"+file)
+		}
+		if match {
 			return filter.level
 		}
 	}
-	l.vmap[pc] = 0
 	return 0
 }
 
@@ -1093,7 +1577,8 @@ type Verbose bool
 
 // V reports whether verbosity at the call site is at least the requested level.
 // The returned value is a boolean of type Verbose, which implements Info, Infoln
-// and Infof. These methods will write to the Info log if called.
+// and Infof, as well as the Warning and Error variants and the Depth variants.
+// These methods will write to the corresponding log if called.
 // Thus, one may write either
 //	if lg.V(2) { lg.Info("log this") }
 // or
@@ -1106,28 +1591,42 @@ type Verbose bool
 // V is at least the value of -v, or of -vmodule for the source file containing the
 // call, the V call will log.
 func V(level Level) Verbose {
+	return logging.v(1, level)
+}
+
+// VDepth acts as V but uses depth to determine which call frame to check
+// against -vmodule. VDepth(0, level) is the same as V(level). It lets logging
+// helpers attribute their V checks to their callers.
+func VDepth(depth int, level Level) Verbose {
+	return logging.v(depth+1, level)
+}
+
+// v implements V for the call frame identified by depth, 1 being the caller
+// of v's caller.
+func (l *loggingT) v(depth int, level Level) Verbose {
 	// This function tries hard to be cheap unless there's work to do.
 	// The fast path is two atomic loads and compares.
 
 	// Here is a cheap but safe test to see if V logging is enabled globally.
-	if logging.verbosity.get() >= level {
+	if l.verbosity.get() >= level {
 		return Verbose(true)
 	}
 
 	// It's off globally but it vmodule may still be set.
 	// Here is another cheap but safe test to see if vmodule is enabled.
-	if atomic.LoadInt32(&logging.filterLength) > 0 {
-		// Now we need a proper lock to use the logging structure. The pcs field
-		// is shared so we must lock before accessing it. This is fairly expensive,
-		// but if V logging is enabled we're slow anyway.
-		logging.mu.Lock()
-		defer logging.mu.Unlock()
-		if runtime.Callers(2, logging.pcs[:]) == 0 {
+	if atomic.LoadInt32(&l.filterLength) > 0 {
+		// Call sites which have been seen before are found in the current
+		// vmap without locking; only new ones need the lock.
+		var pcs [1]uintptr
+		if runtime.Callers(depth+2, pcs[:]) == 0 {
 			return Verbose(false)
 		}
-		v, ok := logging.vmap[logging.pcs[0]]
+		vmap, _ := l.vmap.Load().(map[uintptr]Level)
+		v, ok := vmap[pcs[0]]
 		if !ok {
-			v = logging.setV(logging.pcs[0])
+			l.vmu.Lock()
+			v = l.setV(pcs[0])
+			l.vmu.Unlock()
 		}
 		return Verbose(v >= level)
 	}
@@ -1142,6 +1641,14 @@ func (v Verbose) Info(args ...interface{}) {
 	}
 }
 
+// InfoDepth is equivalent to the global InfoDepth function, guarded by the value of v.
+// See the documentation of V for usage.
+func (v Verbose) InfoDepth(depth int, args ...interface{}) {
+	if v {
+		logging.printDepth(infoLog, depth, args...)
+	}
+}
+
 // Infoln is equivalent to the global Infoln function, guarded by the value of v.
 // See the documentation of V for usage.
 func (v Verbose) Infoln(args ...interface{}) {
@@ -1158,6 +1665,97 @@ func (v Verbose) Infof(format string, args ...interface{}) {
 	}
 }
 
+// Warning is equivalent to the global Warning function, guarded by the value of v.
+// See the documentation of V for usage.
+func (v Verbose) Warning(args ...interface{}) {
+	if v {
+		logging.print(warningLog, args...)
+	}
+}
+
+// WarningDepth is equivalent to the global WarningDepth function, guarded by the value of v.
+// See the documentation of V for usage.
+func (v Verbose) WarningDepth(depth int, args ...interface{}) {
+	if v {
+		logging.printDepth(warningLog, depth, args...)
+	}
+}
+
+// Warningln is equivalent to the global Warningln function, guarded by the value of v.
+// See the documentation of V for usage.
+func (v Verbose) Warningln(args ...interface{}) {
+	if v {
+		logging.println(warningLog, args...)
+	}
+}
+
+// Warningf is equivalent to the global Warningf function, guarded by the value of v.
+// See the documentation of V for usage.
+func (v Verbose) Warningf(format string, args ...interface{}) {
+	if v {
+		logging.printf(warningLog, format, args...)
+	}
+}
+
+// Error is equivalent to the global Error function, guarded by the value of v.
+// See the documentation of V for usage.
+func (v Verbose) Error(args ...interface{}) {
+	if v {
+		logging.print(errorLog, args...)
+	}
+}
+
+// ErrorDepth is equivalent to the global ErrorDepth function, guarded by the value of v.
+// See the documentation of V for usage.
+func (v Verbose) ErrorDepth(depth int, args ...interface{}) {
+	if v {
+		logging.printDepth(errorLog, depth, args...)
+	}
+}
+
+// Errorln is equivalent to the global Errorln function, guarded by the value of v.
+// See the documentation of V for usage.
+func (v Verbose) Errorln(args ...interface{}) {
+	if v {
+		logging.println(errorLog, args...)
+	}
+}
+
+// Errorf is equivalent to the global Errorf function, guarded by the value of v.
+// See the documentation of V for usage.
+func (v Verbose) Errorf(format string, args ...interface{}) {
+	if v {
+		logging.printf(errorLog, format, args...)
+	}
+}
+
+// Debug logs to the DEBUG log, which is the INFO log unless -log_files selects a DEBUG log.
+// DEBUG lines are discarded unless -minloglevel is DEBUG, see SetMinSeverity.
+// Arguments are handled in the manner of fmt.Print; a newline is appended if missing.
+func Debug(args ...interface{}) {
+	logging.print(debugLog, args...)
+}
+
+// DebugDepth acts as Debug but uses depth to determine which call frame to log.
+// DebugDepth(0, "msg") is the same as Debug("msg").
+func DebugDepth(depth int, args ...interface{}) {
+	logging.printDepth(debugLog, depth, args...)
+}
+
+// Debugln logs to the DEBUG log, which is the INFO log unless -log_files selects a DEBUG log.
+// DEBUG lines are discarded unless -minloglevel is DEBUG, see SetMinSeverity.
+// Arguments are handled in the manner of fmt.Println; a newline is appended if missing.
+func Debugln(args ...interface{}) {
+	logging.println(debugLog, args...)
+}
+
+// Debugf logs to the DEBUG log, which is the INFO log unless -log_files selects a DEBUG log.
+// DEBUG lines are discarded unless -minloglevel is DEBUG, see SetMinSeverity.
+// Arguments are handled in the manner of fmt.Printf; a newline is appended if missing.
+func Debugf(format string, args ...interface{}) {
+	logging.printf(debugLog, format, args...)
+}
+
 // Info logs to the INFO log.
 // Arguments are handled in the manner of fmt.Print; a newline is appended if missing.
 func Info(args ...interface{}) {
@@ -1182,6 +1780,30 @@ func Infof(format string, args ...interface{}) {
 	logging.printf(infoLog, format, args...)
 }
 
+// Notice logs to the INFO log, and to the NOTICE and DEBUG logs if -log_files selects them.
+// Arguments are handled in the manner of fmt.Print; a newline is appended if missing.
+func Notice(args ...interface{}) {
+	logging.print(noticeLog, args...)
+}
+
+// NoticeDepth acts as Notice but uses depth to determine which call frame to log.
+// NoticeDepth(0, "msg") is the same as Notice("msg").
+func NoticeDepth(depth int, args ...interface{}) {
+	logging.printDepth(noticeLog, depth, args...)
+}
+
+// Noticeln logs to the INFO log, and to the NOTICE and DEBUG logs if -log_files selects them.
+// Arguments are handled in the manner of fmt.Println; a newline is appended if missing.
+func Noticeln(args ...interface{}) {
+	logging.println(noticeLog, args...)
+}
+
+// Noticef logs to the INFO log, and to the NOTICE and DEBUG logs if -log_files selects them.
+// Arguments are handled in the manner of fmt.Printf; a newline is appended if missing.
+func Noticef(format string, args ...interface{}) {
+	logging.printf(noticeLog, format, args...)
+}
+
 // Warning logs to the WARNING and INFO logs.
 // Arguments are handled in the manner of fmt.Print; a newline is appended if missing.
 func Warning(args ...interface{}) {
@@ -1230,8 +1852,35 @@ func Errorf(format string, args ...interface{}) {
 	logging.printf(errorLog, format, args...)
 }
 
-// Fatal logs to the FATAL, ERROR, WARNING, and INFO logs,
-// including a stack trace of all running goroutines, then calls os.Exit(255).
+// Critical logs to the ERROR, WARNING, and INFO logs, and to the CRITICAL, NOTICE
+// and DEBUG logs if -log_files selects them.
+// Arguments are handled in the manner of fmt.Print; a newline is appended if missing.
+func Critical(args ...interface{}) {
+	logging.print(criticalLog, args...)
+}
+
+// CriticalDepth acts as Critical but uses depth to determine which call frame to log.
+// CriticalDepth(0, "msg") is the same as Critical("msg").
+func CriticalDepth(depth int, args ...interface{}) {
+	logging.printDepth(criticalLog, depth, args...)
+}
+
+// Criticalln logs to the ERROR, WARNING, and INFO logs, and to the CRITICAL, NOTICE
+// and DEBUG logs if -log_files selects them.
+// Arguments are handled in the manner of fmt.Println; a newline is appended if missing.
+func Criticalln(args ...interface{}) {
+	logging.println(criticalLog, args...)
+}
+
+// Criticalf logs to the ERROR, WARNING, and INFO logs, and to the CRITICAL, NOTICE
+// and DEBUG logs if -log_files selects them.
+// Arguments are handled in the manner of fmt.Printf; a newline is appended if missing.
+func Criticalf(format string, args ...interface{}) {
+	logging.printf(criticalLog, format, args...)
+}
+
+// Fatal logs to the FATAL, ERROR, WARNING, and INFO logs, and to the CRITICAL,
+// NOTICE and DEBUG logs if -log_files selects them, including a stack trace of all running goroutines, then calls os.Exit(255).
 // Arguments are handled in the manner of fmt.Print; a newline is appended if missing.
 func Fatal(args ...interface{}) {
 	logging.print(fatalLog, args...)
@@ -1243,15 +1892,15 @@ func FatalDepth(depth int, args ...interface{}) {
 	logging.printDepth(fatalLog, depth, args...)
 }
 
-// Fatalln logs to the FATAL, ERROR, WARNING, and INFO logs,
-// including a stack trace of all running goroutines, then calls os.Exit(255).
+// Fatalln logs to the FATAL, ERROR, WARNING, and INFO logs, and to the CRITICAL,
+// NOTICE and DEBUG logs if -log_files selects them, including a stack trace of all running goroutines, then calls os.Exit(255).
 // Arguments are handled in the manner of fmt.Println; a newline is appended if missing.
 func Fatalln(args ...interface{}) {
 	logging.println(fatalLog, args...)
 }
 
-// Fatalf logs to the FATAL, ERROR, WARNING, and INFO logs,
-// including a stack trace of all running goroutines, then calls os.Exit(255).
+// Fatalf logs to the FATAL, ERROR, WARNING, and INFO logs, and to the CRITICAL,
+// NOTICE and DEBUG logs if -log_files selects them, including a stack trace of all running goroutines, then calls os.Exit(255).
 // Arguments are handled in the manner of fmt.Printf; a newline is appended if missing.
 func Fatalf(format string, args ...interface{}) {
 	logging.printf(fatalLog, format, args...)
@@ -1261,7 +1910,8 @@ func Fatalf(format string, args ...interface{}) {
 // It allows Exit and relatives to use the Fatal logs.
 var fatalNoStacks uint32
 
-// Exit logs to the FATAL, ERROR, WARNING, and INFO logs, then calls os.Exit(1).
+// Exit logs to the FATAL, ERROR, WARNING, and INFO logs, and to the CRITICAL,
+// NOTICE and DEBUG logs if -log_files selects them, then calls os.Exit(1).
 // Arguments are handled in the manner of fmt.Print; a newline is appended if missing.
 func Exit(args ...interface{}) {
 	atomic.StoreUint32(&fatalNoStacks, 1)
@@ -1275,13 +1925,15 @@ func ExitDepth(depth int, args ...interface{}) {
 	logging.printDepth(fatalLog, depth, args...)
 }
 
-// Exitln logs to the FATAL, ERROR, WARNING, and INFO logs, then calls os.Exit(1).
+// Exitln logs to the FATAL, ERROR, WARNING, and INFO logs, and to the CRITICAL,
+// NOTICE and DEBUG logs if -log_files selects them, then calls os.Exit(1).
 func Exitln(args ...interface{}) {
 	atomic.StoreUint32(&fatalNoStacks, 1)
 	logging.println(fatalLog, args...)
 }
 
-// Exitf logs to the FATAL, ERROR, WARNING, and INFO logs, then calls os.Exit(1).
+// Exitf logs to the FATAL, ERROR, WARNING, and INFO logs, and to the CRITICAL,
+// NOTICE and DEBUG logs if -log_files selects them, then calls os.Exit(1).
 // Arguments are handled in the manner of fmt.Printf; a newline is appended if missing.
 func Exitf(format string, args ...interface{}) {
 	atomic.StoreUint32(&fatalNoStacks, 1)
@@ -0,0 +1,206 @@
+package lg
+
+import (
+	"errors"
+	"flag"
+	"sync"
+	"sync/atomic"
+)
+
+// overflowPolicy selects what -log_async does when its queue is full. It
+// implements the flag.Value interface.
+type overflowPolicy int32
+
+const (
+	overflowBlock      overflowPolicy = iota // wait for the writer to catch up
+	overflowDropOldest                       // drop the oldest queued line
+	overflowDropNewest                       // drop the line being logged
+)
+
+var overflowPolicyName = []string{
+	overflowBlock:      "block",
+	overflowDropOldest: "drop_oldest",
+	overflowDropNewest: "drop_newest",
+}
+
+// String is part of the flag.Value interface.
+func (p *overflowPolicy) String() string {
+	return overflowPolicyName[atomic.LoadInt32((*int32)(p))]
+}
+
+// Get is part of the flag.Getter interface.
+func (p *overflowPolicy) Get() interface{} {
+	return overflowPolicy(atomic.LoadInt32((*int32)(p)))
+}
+
+var errOverflowSyntax = errors.New("syntax error: expect one of block, drop_oldest or drop_newest")
+
+// Set is part of the flag.Value interface.
+// Syntax: -log_async_overflow=drop_oldest
+func (p *overflowPolicy) Set(value string) error {
+	for i, name := range overflowPolicyName {
+		if name == value {
+			atomic.StoreInt32((*int32)(p), int32(i))
+			return nil
+		}
+	}
+	return errOverflowSyntax
+}
+
+func init() {
+	flag.IntVar(&logging.asyncSize, "log_async", 0, "if non-zero, queue up to this many lines and write them from a separate goroutine")
+	flag.Var(&logging.asyncOverflow, "log_async_overflow", "what to do when the -log_async queue is full: block, drop_oldest or drop_newest")
+}
+
+// asyncRecord is a formatted line waiting in the -log_async queue.
+type asyncRecord struct {
+	s            severity
+	buf          *buffer
+	pc           uintptr
+	file         string
+	line         int
+	alsoToStderr bool
+	trace        bool   // buf ends with a stack trace
+	seq          uint64 // The number of records enqueued before
+	// repeats are the repeat count lines written before this one, to be
+	// passed to the sinks before it.
+	repeats []repeatSummary
+}
+
+// asyncQueue is the bounded queue of lines written by its writer goroutine.
+type asyncQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond // Signalled whenever records, busy or written change.
+	records []asyncRecord
+	size    int
+	policy  *overflowPolicy
+	busy    bool   // The writer is writing records taken off the queue.
+	nextSeq uint64 // The seq of the next record enqueued
+	written uint64 // Records with a lower seq have been written or dropped
+}
+
+// asyncQueue returns the -log_async queue, starting its writer goroutine the
+// first time it is called, or nil if -log_async is not set.
+func (l *loggingT) asyncQueue() *asyncQueue {
+	if l.asyncSize <= 0 {
+		return nil
+	}
+	l.asyncOnce.Do(func() {
+		q := &asyncQueue{size: l.asyncSize, policy: &l.asyncOverflow}
+		q.cond = sync.NewCond(&q.mu)
+		l.async = q
+		go l.asyncWriter(q)
+	})
+	return l.async
+}
+
+// enqueue adds r to the queue, applying the overflow policy if it is full.
+func (q *asyncQueue) enqueue(r asyncRecord) {
+	q.mu.Lock()
+	if len(q.records) >= q.size {
+		switch overflowPolicy(atomic.LoadInt32((*int32)(q.policy))) {
+		case overflowDropNewest:
+			q.mu.Unlock()
+			dropRecord(r)
+			return
+		case overflowDropOldest:
+			dropRecord(q.records[0])
+			copy(q.records, q.records[1:])
+			q.records = q.records[:len(q.records)-1]
+		default:
+			for len(q.records) >= q.size {
+				q.cond.Wait()
+			}
+		}
+	}
+	r.seq = q.nextSeq
+	q.nextSeq++
+	q.records = append(q.records, r)
+	q.cond.Broadcast()
+	q.mu.Unlock()
+}
+
+// dropRecord counts r as dropped and releases its buffer.
+func dropRecord(r asyncRecord) {
+	if stats := severityStats[r.s]; stats != nil {
+		atomic.AddInt64(&stats.dropped, 1)
+	}
+	logging.putBuffer(r.buf)
+}
+
+// take waits for records and removes all of them from the queue, marking the
+// writer busy until done is called.
+func (q *asyncQueue) take(records []asyncRecord) []asyncRecord {
+	q.mu.Lock()
+	for len(q.records) == 0 {
+		q.cond.Wait()
+	}
+	records = append(records[:0], q.records...)
+	q.records = q.records[:0]
+	q.busy = true
+	q.cond.Broadcast()
+	q.mu.Unlock()
+	return records
+}
+
+// done marks the records returned by take, the last of which had seq last,
+// as written.
+func (q *asyncQueue) done(last uint64) {
+	q.mu.Lock()
+	q.busy = false
+	q.written = last + 1
+	q.cond.Broadcast()
+	q.mu.Unlock()
+}
+
+// drain waits until every record enqueued so far has been written. Records
+// enqueued meanwhile are not waited for, so that it returns under constant
+// load.
+func (q *asyncQueue) drain() {
+	q.mu.Lock()
+	target := q.nextSeq
+	for q.written < target {
+		q.cond.Wait()
+	}
+	q.mu.Unlock()
+}
+
+// asyncWriter writes the records of q as they arrive, holding l.mu once for
+// each batch.
+func (l *loggingT) asyncWriter(q *asyncQueue) {
+	var records []asyncRecord
+	for {
+		records = q.take(records)
+		last := records[len(records)-1].seq
+		l.mu.Lock()
+		for i := range records {
+			r := &records[i]
+			data := r.buf.Bytes()
+			if l.repeated(r.s, data, r.file, r.line) {
+				l.putBuffer(r.buf)
+				r.buf = nil
+				continue
+			}
+			r.repeats = l.takeRepeated()
+			l.write(r.s, data, r.file, r.alsoToStderr, r.trace)
+			if stats := severityStats[r.s]; stats != nil {
+				stats.add(len(data))
+			}
+		}
+		l.mu.Unlock()
+		for i := range records {
+			r := &records[i]
+			if r.buf == nil {
+				continue
+			}
+			if l.toMemory {
+				logToMemory(r.buf.Bytes())
+			}
+			l.sinkRepeated(r.repeats)
+			l.toSinks(r.s, r.buf, r.pc, r.file, r.line)
+			l.putBuffer(r.buf)
+			r.buf, r.repeats = nil, nil
+		}
+		q.done(last)
+	}
+}
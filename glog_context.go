@@ -0,0 +1,340 @@
+package lg
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// Field is a key and value which NewContext attaches to the lines logged with
+// a context.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// KV returns the Field key=value.
+func KV(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+// contextKey is the key of the contextFields of a context.
+type contextKey struct{}
+
+// contextFields are the fields of a context, both as given and formatted as
+// they are appended to log lines.
+type contextFields struct {
+	fields []Field
+	text   []byte
+}
+
+// NewContext returns a copy of ctx carrying fields in addition to those which
+// ctx already carries. Lines logged with the returned context, through
+// FromContext or functions such as InfoCtx, end with the fields formatted as
+// key=value, like those of an Event:
+//
+//	ctx = lg.NewContext(ctx, lg.KV("request_id", id))
+//	lg.InfoCtx(ctx, "served")
+func NewContext(ctx context.Context, fields ...Field) context.Context {
+	cf := &contextFields{}
+	if parent := fieldsOf(ctx); parent != nil {
+		cf.fields = append(cf.fields, parent.fields...)
+		cf.text = append(cf.text, parent.text...)
+	}
+	cf.fields = append(cf.fields, fields...)
+	cf.text = appendFields(cf.text, fields)
+	return context.WithValue(ctx, contextKey{}, cf)
+}
+
+// appendFields appends fields to b formatted as key=value, each preceded by a
+// space.
+func appendFields(b []byte, fields []Field) []byte {
+	for _, f := range fields {
+		b = append(b, ' ')
+		b = append(b, f.Key...)
+		b = append(b, '=')
+		b = appendString(b, fmt.Sprint(f.Value))
+	}
+	return b
+}
+
+// fieldsOf returns the fields of ctx, or nil.
+func fieldsOf(ctx context.Context) *contextFields {
+	cf, _ := ctx.Value(contextKey{}).(*contextFields)
+	return cf
+}
+
+// ContextFields returns the fields carried by ctx, in the order they were
+// added.
+func ContextFields(ctx context.Context) []Field {
+	if cf := fieldsOf(ctx); cf != nil {
+		return append([]Field(nil), cf.fields...)
+	}
+	return nil
+}
+
+// ContextHook is called by the logging functions taking a context, such as
+// InfoCtx, the methods of the Logger returned by FromContext and those of an
+// Event given a context with Ctx, with the context and the severity name and
+// message of each line. The fields it returns are appended to the line after
+// those carried by the context.
+type ContextHook func(ctx context.Context, severity, msg string) []Field
+
+// contextHooks are the hooks registered with AddContextHook.
+var contextHooks struct {
+	sync.RWMutex
+	hooks []ContextHook
+}
+
+// AddContextHook registers hook to be called for every line logged with a
+// context, after the hooks registered before it. Hooks are called without the
+// logging lock held but must not log with a context themselves.
+func AddContextHook(hook ContextHook) {
+	contextHooks.Lock()
+	contextHooks.hooks = append(contextHooks.hooks, hook)
+	contextHooks.Unlock()
+}
+
+// hookFields calls the context hooks for a line and returns the fields they
+// return, appended to fields.
+func hookFields(fields []Field, ctx context.Context, s severity, msg string) []Field {
+	contextHooks.RLock()
+	hooks := contextHooks.hooks
+	contextHooks.RUnlock()
+	for _, hook := range hooks {
+		fields = append(fields, hook(ctx, severityName[s], msg)...)
+	}
+	return fields
+}
+
+// Logger logs lines ending with the fields of a context. It is returned by
+// FromContext.
+type Logger struct {
+	ctx context.Context
+}
+
+// FromContext returns a Logger for the fields carried by ctx.
+func FromContext(ctx context.Context) Logger {
+	return Logger{ctx}
+}
+
+// printFields logs text followed by the fields carried by ctx and those
+// returned by the context hooks.
+func (l *loggingT) printFields(s severity, depth int, ctx context.Context, text string) {
+	if l.discards(s) {
+		return
+	}
+	buf, file, line, pc := l.header(s, depth)
+	msg := strings.TrimSuffix(text, "\n")
+	buf.WriteString(msg)
+	buf.endMessage()
+	if cf := fieldsOf(ctx); cf != nil {
+		buf.Write(cf.text)
+		buf.fields = cf.fields[:len(cf.fields):len(cf.fields)]
+	}
+	if hooked := hookFields(nil, ctx, s, msg); len(hooked) > 0 {
+		buf.Write(appendFields(nil, hooked))
+		buf.fields = append(buf.fields, hooked...)
+	}
+	buf.WriteByte('\n')
+	l.output(s, buf, pc, file, line, false)
+}
+
+// Debug logs to the DEBUG log, like the global Debug function, followed by
+// the fields.
+func (c Logger) Debug(args ...interface{}) {
+	logging.printFields(debugLog, 0, c.ctx, fmt.Sprint(args...))
+}
+
+// DebugDepth acts as Debug but uses depth to determine which call frame to log.
+func (c Logger) DebugDepth(depth int, args ...interface{}) {
+	logging.printFields(debugLog, depth, c.ctx, fmt.Sprint(args...))
+}
+
+// Debugln logs to the DEBUG log, like the global Debugln function, followed by
+// the fields.
+func (c Logger) Debugln(args ...interface{}) {
+	logging.printFields(debugLog, 0, c.ctx, fmt.Sprintln(args...))
+}
+
+// Debugf logs to the DEBUG log, like the global Debugf function, followed by
+// the fields.
+func (c Logger) Debugf(format string, args ...interface{}) {
+	logging.printFields(debugLog, 0, c.ctx, fmt.Sprintf(format, args...))
+}
+
+// Info logs to the INFO log, like the global Info function, followed by
+// the fields.
+func (c Logger) Info(args ...interface{}) {
+	logging.printFields(infoLog, 0, c.ctx, fmt.Sprint(args...))
+}
+
+// InfoDepth acts as Info but uses depth to determine which call frame to log.
+func (c Logger) InfoDepth(depth int, args ...interface{}) {
+	logging.printFields(infoLog, depth, c.ctx, fmt.Sprint(args...))
+}
+
+// Infoln logs to the INFO log, like the global Infoln function, followed by
+// the fields.
+func (c Logger) Infoln(args ...interface{}) {
+	logging.printFields(infoLog, 0, c.ctx, fmt.Sprintln(args...))
+}
+
+// Infof logs to the INFO log, like the global Infof function, followed by
+// the fields.
+func (c Logger) Infof(format string, args ...interface{}) {
+	logging.printFields(infoLog, 0, c.ctx, fmt.Sprintf(format, args...))
+}
+
+// Notice logs to the INFO log, like the global Notice function, followed by
+// the fields.
+func (c Logger) Notice(args ...interface{}) {
+	logging.printFields(noticeLog, 0, c.ctx, fmt.Sprint(args...))
+}
+
+// NoticeDepth acts as Notice but uses depth to determine which call frame to log.
+func (c Logger) NoticeDepth(depth int, args ...interface{}) {
+	logging.printFields(noticeLog, depth, c.ctx, fmt.Sprint(args...))
+}
+
+// Noticeln logs to the INFO log, like the global Noticeln function, followed by
+// the fields.
+func (c Logger) Noticeln(args ...interface{}) {
+	logging.printFields(noticeLog, 0, c.ctx, fmt.Sprintln(args...))
+}
+
+// Noticef logs to the INFO log, like the global Noticef function, followed by
+// the fields.
+func (c Logger) Noticef(format string, args ...interface{}) {
+	logging.printFields(noticeLog, 0, c.ctx, fmt.Sprintf(format, args...))
+}
+
+// Warning logs to the WARNING and INFO logs, like the global Warning function, followed by
+// the fields.
+func (c Logger) Warning(args ...interface{}) {
+	logging.printFields(warningLog, 0, c.ctx, fmt.Sprint(args...))
+}
+
+// WarningDepth acts as Warning but uses depth to determine which call frame to log.
+func (c Logger) WarningDepth(depth int, args ...interface{}) {
+	logging.printFields(warningLog, depth, c.ctx, fmt.Sprint(args...))
+}
+
+// Warningln logs to the WARNING and INFO logs, like the global Warningln function, followed by
+// the fields.
+func (c Logger) Warningln(args ...interface{}) {
+	logging.printFields(warningLog, 0, c.ctx, fmt.Sprintln(args...))
+}
+
+// Warningf logs to the WARNING and INFO logs, like the global Warningf function, followed by
+// the fields.
+func (c Logger) Warningf(format string, args ...interface{}) {
+	logging.printFields(warningLog, 0, c.ctx, fmt.Sprintf(format, args...))
+}
+
+// Error logs to the ERROR, WARNING, and INFO logs, like the global Error function, followed by
+// the fields.
+func (c Logger) Error(args ...interface{}) {
+	logging.printFields(errorLog, 0, c.ctx, fmt.Sprint(args...))
+}
+
+// ErrorDepth acts as Error but uses depth to determine which call frame to log.
+func (c Logger) ErrorDepth(depth int, args ...interface{}) {
+	logging.printFields(errorLog, depth, c.ctx, fmt.Sprint(args...))
+}
+
+// Errorln logs to the ERROR, WARNING, and INFO logs, like the global Errorln function, followed by
+// the fields.
+func (c Logger) Errorln(args ...interface{}) {
+	logging.printFields(errorLog, 0, c.ctx, fmt.Sprintln(args...))
+}
+
+// Errorf logs to the ERROR, WARNING, and INFO logs, like the global Errorf function, followed by
+// the fields.
+func (c Logger) Errorf(format string, args ...interface{}) {
+	logging.printFields(errorLog, 0, c.ctx, fmt.Sprintf(format, args...))
+}
+
+// Critical logs to the ERROR, WARNING, and INFO logs, like the global Critical function, followed by
+// the fields.
+func (c Logger) Critical(args ...interface{}) {
+	logging.printFields(criticalLog, 0, c.ctx, fmt.Sprint(args...))
+}
+
+// CriticalDepth acts as Critical but uses depth to determine which call frame to log.
+func (c Logger) CriticalDepth(depth int, args ...interface{}) {
+	logging.printFields(criticalLog, depth, c.ctx, fmt.Sprint(args...))
+}
+
+// Criticalln logs to the ERROR, WARNING, and INFO logs, like the global Criticalln function, followed by
+// the fields.
+func (c Logger) Criticalln(args ...interface{}) {
+	logging.printFields(criticalLog, 0, c.ctx, fmt.Sprintln(args...))
+}
+
+// Criticalf logs to the ERROR, WARNING, and INFO logs, like the global Criticalf function, followed by
+// the fields.
+func (c Logger) Criticalf(format string, args ...interface{}) {
+	logging.printFields(criticalLog, 0, c.ctx, fmt.Sprintf(format, args...))
+}
+
+// DebugCtx is equivalent to FromContext(ctx).Debug(args...).
+func DebugCtx(ctx context.Context, args ...interface{}) {
+	logging.printFields(debugLog, 0, ctx, fmt.Sprint(args...))
+}
+
+// DebugfCtx is equivalent to FromContext(ctx).Debugf(format, args...).
+func DebugfCtx(ctx context.Context, format string, args ...interface{}) {
+	logging.printFields(debugLog, 0, ctx, fmt.Sprintf(format, args...))
+}
+
+// InfoCtx is equivalent to FromContext(ctx).Info(args...).
+func InfoCtx(ctx context.Context, args ...interface{}) {
+	logging.printFields(infoLog, 0, ctx, fmt.Sprint(args...))
+}
+
+// InfofCtx is equivalent to FromContext(ctx).Infof(format, args...).
+func InfofCtx(ctx context.Context, format string, args ...interface{}) {
+	logging.printFields(infoLog, 0, ctx, fmt.Sprintf(format, args...))
+}
+
+// NoticeCtx is equivalent to FromContext(ctx).Notice(args...).
+func NoticeCtx(ctx context.Context, args ...interface{}) {
+	logging.printFields(noticeLog, 0, ctx, fmt.Sprint(args...))
+}
+
+// NoticefCtx is equivalent to FromContext(ctx).Noticef(format, args...).
+func NoticefCtx(ctx context.Context, format string, args ...interface{}) {
+	logging.printFields(noticeLog, 0, ctx, fmt.Sprintf(format, args...))
+}
+
+// WarningCtx is equivalent to FromContext(ctx).Warning(args...).
+func WarningCtx(ctx context.Context, args ...interface{}) {
+	logging.printFields(warningLog, 0, ctx, fmt.Sprint(args...))
+}
+
+// WarningfCtx is equivalent to FromContext(ctx).Warningf(format, args...).
+func WarningfCtx(ctx context.Context, format string, args ...interface{}) {
+	logging.printFields(warningLog, 0, ctx, fmt.Sprintf(format, args...))
+}
+
+// ErrorCtx is equivalent to FromContext(ctx).Error(args...).
+func ErrorCtx(ctx context.Context, args ...interface{}) {
+	logging.printFields(errorLog, 0, ctx, fmt.Sprint(args...))
+}
+
+// ErrorfCtx is equivalent to FromContext(ctx).Errorf(format, args...).
+func ErrorfCtx(ctx context.Context, format string, args ...interface{}) {
+	logging.printFields(errorLog, 0, ctx, fmt.Sprintf(format, args...))
+}
+
+// CriticalCtx is equivalent to FromContext(ctx).Critical(args...).
+func CriticalCtx(ctx context.Context, args ...interface{}) {
+	logging.printFields(criticalLog, 0, ctx, fmt.Sprint(args...))
+}
+
+// CriticalfCtx is equivalent to FromContext(ctx).Criticalf(format, args...).
+func CriticalfCtx(ctx context.Context, format string, args ...interface{}) {
+	logging.printFields(criticalLog, 0, ctx, fmt.Sprintf(format, args...))
+}
@@ -0,0 +1,98 @@
+package lg
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"time"
+)
+
+func init() {
+	flag.DurationVar(&logging.dedupWindow, "log_dedup", 0, "if non-zero, collapse identical consecutive log lines within this window into a repeat count")
+}
+
+// dedupState remembers the last line written, for the -log_dedup flag.
+type dedupState struct {
+	sev   severity
+	file  string
+	line  int
+	key   []byte    // The line without its timestamp
+	first time.Time // The time the line was first written
+	count int       // The number of repeats not written
+
+	// summaries are the repeat count lines written to the log files but not
+	// yet passed to the sinks, which is done once l.mu is released.
+	summaries []repeatSummary
+}
+
+// repeatSummary is a repeat count line waiting to be passed to the sinks.
+type repeatSummary struct {
+	buf  *buffer
+	sev  severity
+	file string
+	line int
+}
+
+// repeated reports whether data is identical to the previous line, apart from
+// its timestamp, and within the -log_dedup window, in which case it is
+// counted and must not be written. Otherwise any pending repeat count is
+// written first and data becomes the line compared against.
+// l.mu is held.
+func (l *loggingT) repeated(s severity, data []byte, file string, line int) bool {
+	if l.dedupWindow <= 0 || len(data) < headerPrefixLen {
+		return false
+	}
+	now := timeNow()
+	key := data[headerPrefixLen:]
+	d := &l.dedup
+	if d.key != nil && s == d.sev && now.Sub(d.first) < l.dedupWindow && bytes.Equal(key, d.key) {
+		d.count++
+		return true
+	}
+	l.flushRepeated()
+	d.sev, d.file, d.line, d.first = s, file, line, now
+	d.key = append(d.key[:0], key...)
+	return false
+}
+
+// flushRepeated writes a line telling how many times the previous line was
+// repeated, if it was.
+// l.mu is held.
+func (l *loggingT) flushRepeated() {
+	d := &l.dedup
+	if d.count == 0 {
+		return
+	}
+	buf := l.formatHeader(d.sev, d.file, d.line, "")
+	fmt.Fprintf(buf, "last message repeated %d times", d.count)
+	buf.endMessage()
+	buf.WriteByte('\n')
+	d.count = 0
+	l.write(d.sev, buf.Bytes(), d.file, false, false)
+	if l.toMemory {
+		logToMemory(buf.Bytes())
+	}
+	if !hasSinks() {
+		l.putBuffer(buf)
+		return
+	}
+	d.summaries = append(d.summaries, repeatSummary{buf, d.sev, d.file, d.line})
+}
+
+// takeRepeated returns the repeat count lines waiting to be passed to the
+// sinks, for sinkRepeated.
+// l.mu is held.
+func (l *loggingT) takeRepeated() []repeatSummary {
+	summaries := l.dedup.summaries
+	l.dedup.summaries = nil
+	return summaries
+}
+
+// sinkRepeated passes summaries, as returned by takeRepeated, to the sinks.
+// l.mu is not held.
+func (l *loggingT) sinkRepeated(summaries []repeatSummary) {
+	for _, r := range summaries {
+		l.toSinks(r.sev, r.buf, 0, r.file, r.line)
+		l.putBuffer(r.buf)
+	}
+}
@@ -0,0 +1,279 @@
+package lg
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Event is a log line built from typed fields, which is formatted into a
+// pooled buffer without allocating. It is obtained from InfoEvent,
+// WarningEvent, ErrorEvent or their counterparts for the other severities and
+// written by calling Msg or Msgf, after which it must not be used again:
+//
+//	lg.InfoEvent().Str("method", method).Int("status", code).Msg("served")
+//
+// logs the fields after the message:
+//
+//	I0102 15:04:05.067890    1234 server.go:42] served method=GET status=200
+//
+// String values containing spaces, quotes or equal signs are quoted.
+// A nil *Event, as returned by Verbose.InfoEvent when V is off, discards all
+// fields and does not log.
+type Event struct {
+	s      severity
+	fields []byte
+	ctx    context.Context // The context given to Ctx, for the context hooks
+	// list holds the fields as values as well, for the sinks, if there
+	// were any when the Event was created.
+	list       []Field
+	structured bool
+}
+
+// maxEventSize is the capacity above which the fields of an Event are not reused.
+const maxEventSize = 4 * 1024
+
+var eventPool = sync.Pool{
+	New: func() interface{} {
+		return &Event{fields: make([]byte, 0, 256)}
+	},
+}
+
+func newEvent(s severity) *Event {
+	if logging.discards(s) {
+		return nil
+	}
+	e := eventPool.Get().(*Event)
+	e.s = s
+	e.fields = e.fields[:0]
+	e.list = e.list[:0]
+	e.structured = hasSinks()
+	return e
+}
+
+// DebugEvent returns an Event which logs to the DEBUG log, or nil unless
+// -minloglevel is DEBUG.
+func DebugEvent() *Event {
+	return newEvent(debugLog)
+}
+
+// InfoEvent returns an Event which logs to the INFO log.
+func InfoEvent() *Event {
+	return newEvent(infoLog)
+}
+
+// NoticeEvent returns an Event which logs to the INFO log, and to the NOTICE
+// and DEBUG logs if -log_files selects them.
+func NoticeEvent() *Event {
+	return newEvent(noticeLog)
+}
+
+// WarningEvent returns an Event which logs to the WARNING and INFO logs.
+func WarningEvent() *Event {
+	return newEvent(warningLog)
+}
+
+// ErrorEvent returns an Event which logs to the ERROR, WARNING, and INFO logs.
+func ErrorEvent() *Event {
+	return newEvent(errorLog)
+}
+
+// CriticalEvent returns an Event which logs to the ERROR, WARNING, and INFO
+// logs, and to the CRITICAL, NOTICE and DEBUG logs if -log_files selects them.
+func CriticalEvent() *Event {
+	return newEvent(criticalLog)
+}
+
+// InfoEvent is equivalent to the global InfoEvent function, guarded by the
+// value of v. It returns nil if v is false.
+// See the documentation of V for usage.
+func (v Verbose) InfoEvent() *Event {
+	if v {
+		return newEvent(infoLog)
+	}
+	return nil
+}
+
+// key appends the separator and key of a field.
+func (e *Event) key(k string) {
+	e.fields = append(e.fields, ' ')
+	e.fields = append(e.fields, k...)
+	e.fields = append(e.fields, '=')
+}
+
+// Str adds the field k with string value v.
+func (e *Event) Str(k, v string) *Event {
+	if e != nil {
+		e.key(k)
+		if e.structured {
+			e.list = append(e.list, Field{k, v})
+		}
+		e.fields = appendString(e.fields, v)
+	}
+	return e
+}
+
+// Int adds the field k with integer value v.
+func (e *Event) Int(k string, v int) *Event {
+	if e != nil {
+		e.key(k)
+		if e.structured {
+			e.list = append(e.list, Field{k, v})
+		}
+		e.fields = strconv.AppendInt(e.fields, int64(v), 10)
+	}
+	return e
+}
+
+// Int64 adds the field k with integer value v.
+func (e *Event) Int64(k string, v int64) *Event {
+	if e != nil {
+		e.key(k)
+		if e.structured {
+			e.list = append(e.list, Field{k, v})
+		}
+		e.fields = strconv.AppendInt(e.fields, v, 10)
+	}
+	return e
+}
+
+// Uint64 adds the field k with unsigned integer value v.
+func (e *Event) Uint64(k string, v uint64) *Event {
+	if e != nil {
+		e.key(k)
+		if e.structured {
+			e.list = append(e.list, Field{k, v})
+		}
+		e.fields = strconv.AppendUint(e.fields, v, 10)
+	}
+	return e
+}
+
+// Float64 adds the field k with floating point value v.
+func (e *Event) Float64(k string, v float64) *Event {
+	if e != nil {
+		e.key(k)
+		if e.structured {
+			e.list = append(e.list, Field{k, v})
+		}
+		e.fields = strconv.AppendFloat(e.fields, v, 'g', -1, 64)
+	}
+	return e
+}
+
+// Bool adds the field k with boolean value v.
+func (e *Event) Bool(k string, v bool) *Event {
+	if e != nil {
+		e.key(k)
+		if e.structured {
+			e.list = append(e.list, Field{k, v})
+		}
+		e.fields = strconv.AppendBool(e.fields, v)
+	}
+	return e
+}
+
+// Err adds the field err with the message of err, or nil.
+func (e *Event) Err(err error) *Event {
+	if e != nil {
+		e.key("err")
+		if e.structured {
+			e.list = append(e.list, Field{"err", err})
+		}
+		if err == nil {
+			e.fields = append(e.fields, "nil"...)
+		} else {
+			e.fields = appendString(e.fields, err.Error())
+		}
+	}
+	return e
+}
+
+// Ctx adds the fields carried by ctx, see NewContext, and those returned for
+// ctx by the context hooks, see AddContextHook.
+func (e *Event) Ctx(ctx context.Context) *Event {
+	if e != nil {
+		if cf := fieldsOf(ctx); cf != nil {
+			e.fields = append(e.fields, cf.text...)
+			if e.structured {
+				e.list = append(e.list, cf.fields...)
+			}
+		}
+		e.ctx = ctx
+	}
+	return e
+}
+
+// Msg logs msg followed by the fields of the event.
+func (e *Event) Msg(msg string) {
+	if e != nil {
+		logging.printEvent(e, msg)
+		e.free()
+	}
+}
+
+// Msgf logs a message formatted in the manner of fmt.Printf, followed by the
+// fields of the event. Unlike Msg, it allocates.
+func (e *Event) Msgf(format string, args ...interface{}) {
+	if e != nil {
+		logging.printEvent(e, fmt.Sprintf(format, args...))
+		e.free()
+	}
+}
+
+// free returns e to the pool.
+func (e *Event) free() {
+	e.ctx = nil
+	for i := range e.list {
+		e.list[i] = Field{} // Do not keep the values alive.
+	}
+	if cap(e.fields) <= maxEventSize {
+		eventPool.Put(e)
+	}
+}
+
+// printEvent logs msg and the fields of e.
+func (l *loggingT) printEvent(e *Event, msg string) {
+	buf, file, line, pc := l.header(e.s, 0)
+	msg = strings.TrimSuffix(msg, "\n")
+	buf.WriteString(msg)
+	buf.endMessage()
+	if e.ctx != nil {
+		if hooked := hookFields(nil, e.ctx, e.s, msg); len(hooked) > 0 {
+			e.fields = appendFields(e.fields, hooked)
+			if e.structured {
+				e.list = append(e.list, hooked...)
+			}
+		}
+	}
+	buf.Write(e.fields)
+	if e.structured {
+		// The list is reused with e, so the sinks get a copy.
+		buf.fields = append([]Field(nil), e.list...)
+	}
+	buf.WriteByte('\n')
+	l.output(e.s, buf, pc, file, line, false)
+}
+
+// appendString appends s to b, quoted if it is empty or contains characters
+// which would make the field ambiguous.
+func appendString(b []byte, s string) []byte {
+	if needsQuote(s) {
+		return strconv.AppendQuote(b, s)
+	}
+	return append(b, s...)
+}
+
+func needsQuote(s string) bool {
+	if len(s) == 0 {
+		return true
+	}
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c <= ' ' || c == '"' || c == '=' || c >= 0x7f {
+			return true
+		}
+	}
+	return false
+}
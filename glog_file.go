@@ -25,12 +25,17 @@ import (
 	"os"
 	"os/user"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/thomasf/lg/pkg/lgname"
 )
 
-// MaxSize is the maximum size of a log file in bytes.
+// MaxSize is the maximum size of a log file in bytes. It does not apply with
+// -log_stable_names.
 var MaxSize uint64 = 1024 * 1024 * 1800
 
 // logDirs lists the candidate directories for new log files.
@@ -40,11 +45,106 @@ var logDirs []string
 // See createLogDirs for the full list of possible destinations.
 var logDir = flag.String("log_dir", "", "If non-empty, write log files in this directory")
 
+// If true, log files are named after the program and severity only, which is
+// the name otherwise used for the symlink, and appended to rather than
+// rotated. This suits external rotation tools such as logrotate.
+var stableNames = flag.Bool("log_stable_names", false, "If true, write log files with stable names, without a timestamp, and leave rotating them to external tools")
+
+// Candidate directories tried in order after -log_dir. Entries may refer to
+// environment variables, see expandLogDir.
+var logDirList = flag.String("log_dirs", "", "comma-separated list of directories to write log files in if -log_dir is unusable, such as $XDG_STATE_HOME/$PROGRAM,$TMPDIR (the default is $TMPDIR)")
+
+// If non-empty, log files are given to this group, by name or numeric id.
+var logGroup = flag.String("log_group", "", "If non-empty, the group, by name or id, to give log files to")
+
+// The permissions of new log files and, if non-zero, of the log directories
+// created when missing. Log lines may contain private data, so neither is
+// readable by other users by default.
+var (
+	logFileMode = fileMode(0640)
+	logDirMode  = fileMode(0750)
+)
+
+// fileMode is an os.FileMode flag written in octal. It implements the
+// flag.Value interface.
+type fileMode os.FileMode
+
+// String is part of the flag.Value interface.
+func (m *fileMode) String() string {
+	return fmt.Sprintf("%#o", uint32(*m))
+}
+
+// Get is part of the flag.Getter interface.
+func (m *fileMode) Get() interface{} {
+	return os.FileMode(*m)
+}
+
+// Set is part of the flag.Value interface.
+// Syntax: -log_file_mode=0640
+func (m *fileMode) Set(value string) error {
+	v, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || os.FileMode(v)&^os.ModePerm != 0 {
+		return fmt.Errorf("syntax error: expect octal permission bits, got %q", value)
+	}
+	*m = fileMode(v)
+	return nil
+}
+
 func createLogDirs() {
 	if *logDir != "" {
 		logDirs = append(logDirs, *logDir)
 	}
-	logDirs = append(logDirs, os.TempDir())
+	if *logDirList == "" {
+		logDirs = append(logDirs, os.TempDir())
+		return
+	}
+	for _, dir := range strings.Split(*logDirList, ",") {
+		if dir = expandLogDir(strings.TrimSpace(dir)); dir != "" {
+			logDirs = append(logDirs, dir)
+		}
+	}
+}
+
+// expandLogDir replaces the $VAR and ${VAR} references in dir by the values of
+// the environment variables, except for $PROGRAM, the program name, $TMPDIR,
+// which is os.TempDir, and $XDG_STATE_HOME, which defaults to
+// $HOME/.local/state. If a variable is empty, the directory is skipped and
+// expandLogDir returns the empty string.
+func expandLogDir(dir string) string {
+	missing := false
+	dir = os.Expand(dir, func(name string) string {
+		v := logDirVar(name)
+		if v == "" {
+			missing = true
+		}
+		return v
+	})
+	if missing {
+		return ""
+	}
+	return dir
+}
+
+// logDirVar returns the value of the variable name for expandLogDir.
+func logDirVar(name string) string {
+	switch name {
+	case "PROGRAM":
+		return programName()
+	case "TMPDIR":
+		return os.TempDir()
+	case "HOME":
+		home, _ := os.UserHomeDir()
+		return home
+	case "XDG_STATE_HOME":
+		if v := os.Getenv(name); v != "" {
+			return v
+		}
+		if home, _ := os.UserHomeDir(); home != "" {
+			return filepath.Join(home, ".local", "state")
+		}
+		return ""
+	}
+	return os.Getenv(name)
 }
 
 var (
@@ -55,6 +155,9 @@ var (
 )
 
 func init() {
+	flag.Var(&logFileMode, "log_file_mode", "permissions of new log files, in octal; not readable by other users by default, use 0644 or 0666 for the former behavior")
+	flag.Var(&logDirMode, "log_dir_mode", "if non-zero, create missing log directories with these permissions, in octal; 0 leaves creating them to the user")
+
 	h, err := os.Hostname()
 	if err == nil {
 		host = shortHostname(h)
@@ -78,22 +181,160 @@ func shortHostname(hostname string) string {
 	return hostname
 }
 
+// If non-empty, overrides the program name in log file names.
+var programOverride = flag.String("log_program", "", "If non-empty, the program name to use in log file names instead of the executable's")
+
+// ProgramName returns the program name used in log file names, which is the
+// base name of the executable unless the -log_program flag is set. Sinks use
+// it to identify the program as well.
+func ProgramName() string {
+	return programName()
+}
+
+// programName returns the program name to use in log file names.
+func programName() string {
+	if *programOverride != "" {
+		return *programOverride
+	}
+	return program
+}
+
+// The templates of log file and symlink names.
+var (
+	fileTemplate = nameTemplate{Template: lgname.MustParse(lgname.DefaultTemplate)}
+	linkTemplate = nameTemplate{Template: lgname.MustParse(lgname.DefaultLinkTemplate), link: true}
+)
+
+// nameTemplate is a log file name template. It implements the flag.Value
+// interface.
+type nameTemplate struct {
+	*lgname.Template
+	link bool // It is the template of the symlinks
+}
+
+// String is part of the flag.Value interface.
+func (t *nameTemplate) String() string {
+	if t.Template == nil {
+		return ""
+	}
+	return t.Template.String()
+}
+
+// Set is part of the flag.Value interface.
+// Syntax: -log_file_template={program}.{tag}.{time}.log
+func (t *nameTemplate) Set(value string) error {
+	tmpl, err := lgname.Parse(value)
+	if err != nil {
+		return err
+	}
+	if !tmpl.Has("tag") {
+		return fmt.Errorf("log: template %q lacks the {tag} field", value)
+	}
+	// Log files are created exclusively, so each must get a new name.
+	if !t.link && !tmpl.Has("time") && !tmpl.Has("seq") {
+		return fmt.Errorf("log: template %q lacks the {time} or {seq} field", value)
+	}
+	// Creating the symlink would replace the log file by a link to itself.
+	other := &linkTemplate
+	if t.link {
+		other = &fileTemplate
+	}
+	if other.Template != nil && other.String() == tmpl.String() {
+		return fmt.Errorf("log: the log file and symlink templates are both %q", value)
+	}
+	t.Template = tmpl
+	return nil
+}
+
+func init() {
+	flag.Var(&fileTemplate, "log_file_template", "template of log file names, with the fields {program}, {host}, {user}, {tag}, {time}, {pid} and {seq}, which must include {tag} and {time} or {seq}")
+	flag.Var(&linkTemplate, "log_link_template", "template of the names of the symlinks to the latest log files, or of the files themselves with -log_stable_names")
+}
+
+// fileSeq counts the log files created for each tag, for the {seq} field.
+// logging.mu is held when it is accessed.
+var fileSeq = make(map[string]int)
+
 // logName returns a new log file name containing tag, with start time t, and
 // the name for the symlink for tag.
 func logName(tag string, t time.Time) (name, link string) {
-	name = fmt.Sprintf("%s.%s.%s.log.%s.%04d%02d%02d-%02d%02d%02d.%d",
-		program,
-		host,
-		userName,
-		tag,
-		t.Year(),
-		t.Month(),
-		t.Day(),
-		t.Hour(),
-		t.Minute(),
-		t.Second(),
-		pid)
-	return name, program + "." + tag
+	n := lgname.Name{
+		Program: programName(),
+		Host:    host,
+		User:    userName,
+		Tag:     tag,
+		Time:    t,
+		Pid:     pid,
+		Seq:     fileSeq[tag],
+	}
+	fileSeq[tag]++
+	return fileTemplate.Format(n), linkTemplate.Format(n)
+}
+
+// severityFiles is a set of severities which have their own log file. It
+// implements the flag.Value interface and is handled atomically.
+type severityFiles uint32
+
+// defaultSeverityFiles are the files of the original glog severities. DEBUG
+// lines go to the INFO file and NOTICE and CRITICAL lines to the files below
+// them.
+const defaultSeverityFiles = severityFiles(1<<infoLog | 1<<warningLog | 1<<errorLog | 1<<fatalLog)
+
+// get returns the value of the severityFiles.
+func (f *severityFiles) get() severityFiles {
+	return severityFiles(atomic.LoadUint32((*uint32)(f)))
+}
+
+// has reports whether s has its own log file.
+func (f severityFiles) has(s severity) bool {
+	return f&(1<<uint(s)) != 0
+}
+
+// lowest returns the lowest severity which has its own log file.
+func (f severityFiles) lowest() severity {
+	s := debugLog
+	for s < fatalLog && !f.has(s) {
+		s++
+	}
+	return s
+}
+
+// String is part of the flag.Value interface.
+func (f *severityFiles) String() string {
+	var names []string
+	v := f.get()
+	for s := debugLog; s < numSeverity; s++ {
+		if v.has(s) {
+			names = append(names, severityName[s])
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// Get is part of the flag.Getter interface.
+func (f *severityFiles) Get() interface{} {
+	return f.get()
+}
+
+// Set is part of the flag.Value interface.
+// Syntax: -log_files=INFO,ERROR
+func (f *severityFiles) Set(value string) error {
+	var v severityFiles
+	for _, name := range strings.Split(value, ",") {
+		s, ok := severityByName(strings.TrimSpace(name))
+		if !ok {
+			return fmt.Errorf("log: unknown severity %q in -log_files", name)
+		}
+		v |= 1 << uint(s)
+	}
+	atomic.StoreUint32((*uint32)(f), uint32(v))
+	return nil
+}
+
+func init() {
+	logging.files = defaultSeverityFiles
+	flag.Var(&logging.files, "log_files", "comma-separated severities which have a log file, a line being written to those at or below its severity, or to the lowest one if there are none: INFO alone gives a single combined file")
+	flag.BoolVar(&logging.fanout, "log_fanout", true, "write each line to all the -log_files at or below its severity, rather than only to the closest one")
 }
 
 var onceLogDirs sync.Once
@@ -101,24 +342,79 @@ var onceLogDirs sync.Once
 // create creates a new log file and returns the file and its filename, which
 // contains tag ("INFO", "FATAL", etc.) and t.  If the file is created
 // successfully, create also attempts to update the symlink for that tag, ignoring
-// errors.
+// errors. With -log_stable_names, the file is instead named like the symlink
+// and opened for appending. Each of logDirs is tried in turn, and the error
+// returned when all fail lists why each of them did.
+//
+// An existing log file is never truncated. If the name is taken, the next
+// {seq} is tried when the template has that field, and otherwise the
+// *os.PathError for which os.IsExist is true is returned.
 func create(tag string, t time.Time) (f *os.File, filename string, err error) {
 	onceLogDirs.Do(createLogDirs)
 	if len(logDirs) == 0 {
 		return nil, "", errors.New("log: no log dirs")
 	}
 	name, link := logName(tag, t)
-	var lastErr error
+	errs := make([]string, 0, len(logDirs))
 	for _, dir := range logDirs {
-		fname := filepath.Join(dir, name)
-		f, err := os.Create(fname)
+		f, fname, err := createIn(dir, name, link)
+		for os.IsExist(err) && fileTemplate.Has("seq") {
+			name, link = logName(tag, t)
+			f, fname, err = createIn(dir, name, link)
+		}
 		if err == nil {
-			symlink := filepath.Join(dir, link)
-			os.Remove(symlink)        // ignore err
-			os.Symlink(name, symlink) // ignore err
 			return f, fname, nil
 		}
-		lastErr = err
+		if os.IsExist(err) {
+			return nil, "", err
+		}
+		errs = append(errs, err.Error())
+	}
+	return nil, "", fmt.Errorf("log: cannot create log in any of %d directories: %s", len(logDirs), strings.Join(errs, "; "))
+}
+
+// createIn creates the log file name in dir, as described by create.
+func createIn(dir, name, link string) (*os.File, string, error) {
+	if logDirMode != 0 {
+		if err := os.MkdirAll(dir, os.FileMode(logDirMode)); err != nil {
+			return nil, "", err
+		}
+	}
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if *stableNames {
+		name = link
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+	}
+	fname := filepath.Join(dir, name)
+	f, err := os.OpenFile(fname, flags, os.FileMode(logFileMode))
+	if err != nil {
+		return nil, "", err
+	}
+	if *logGroup != "" {
+		if err := chgrp(f, *logGroup); err != nil {
+			f.Close()
+			return nil, "", err
+		}
+	}
+	if !*stableNames {
+		symlink := filepath.Join(dir, link)
+		os.Remove(symlink)        // ignore err
+		os.Symlink(name, symlink) // ignore err
+	}
+	return f, fname, nil
+}
+
+// chgrp gives f to group, a group name or numeric id.
+func chgrp(f *os.File, group string) error {
+	gid, err := strconv.Atoi(group)
+	if err != nil {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return err
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return fmt.Errorf("log: group %s has non-numeric id %s", group, g.Gid)
+		}
 	}
-	return nil, "", fmt.Errorf("log: cannot create log: %v", lastErr)
+	return f.Chown(-1, gid)
 }
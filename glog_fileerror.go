@@ -0,0 +1,198 @@
+package lg
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// errorPolicy selects what happens when the log files cannot be created or
+// written. It implements the flag.Value interface and is handled atomically.
+type errorPolicy int32
+
+const (
+	errorExit   errorPolicy = iota // flush what we can and exit with status 2
+	errorStderr                    // write to standard error from now on
+	errorRetry                     // write to standard error while retrying the files with backoff
+	errorDrop                      // drop and count lines while retrying the files with backoff
+)
+
+var errorPolicyName = []string{
+	errorExit:   "exit",
+	errorStderr: "stderr",
+	errorRetry:  "retry",
+	errorDrop:   "drop",
+}
+
+// get returns the value of the errorPolicy.
+func (p *errorPolicy) get() errorPolicy {
+	return errorPolicy(atomic.LoadInt32((*int32)(p)))
+}
+
+// String is part of the flag.Value interface.
+func (p *errorPolicy) String() string {
+	return errorPolicyName[p.get()]
+}
+
+// Get is part of the flag.Getter interface.
+func (p *errorPolicy) Get() interface{} {
+	return p.get()
+}
+
+var errErrorPolicySyntax = errors.New("syntax error: expect one of exit, stderr, retry or drop")
+
+// Set is part of the flag.Value interface.
+// Syntax: -log_error_policy=retry
+func (p *errorPolicy) Set(value string) error {
+	for i, name := range errorPolicyName {
+		if name == value {
+			atomic.StoreInt32((*int32)(p), int32(i))
+			return nil
+		}
+	}
+	return errErrorPolicySyntax
+}
+
+func init() {
+	flag.Var(&logging.errorPolicy, "log_error_policy", "what to do when the log files cannot be written: exit, stderr, retry (writing to stderr meanwhile) or drop (counting dropped lines meanwhile)")
+}
+
+// Bounds of the delay between attempts to recreate the log files under the
+// retry and drop policies.
+const (
+	minFileRetry = time.Second
+	maxFileRetry = time.Minute
+)
+
+// fileErrorState tracks the log files after an error, for -log_error_policy.
+type fileErrorState struct {
+	failed  bool          // The files were given up on
+	retryAt time.Time     // When to try creating the files again
+	backoff time.Duration // The delay before the next attempt, zero once the files work
+}
+
+// errFilesDown is returned by writeFiles while the files are given up on.
+var errFilesDown = errors.New("log: log files unavailable")
+
+// OnFileError registers fn to be called with every error creating or writing
+// the log files, before -log_error_policy is applied. It is called with the
+// logging lock held and must not log.
+func OnFileError(fn func(err error)) {
+	logging.mu.Lock()
+	logging.onFileError = fn
+	logging.mu.Unlock()
+}
+
+// writeFiles writes data to the log files selected by -log_files for
+// severity s and below, or only to the first of them without -log_fanout,
+// creating them first if needed. If there are none, data is written to the
+// lowest selected file instead.
+// l.mu is held.
+func (l *loggingT) writeFiles(s severity, data []byte) error {
+	if e := &l.fileErr; e.failed {
+		if l.errorPolicy.get() == errorStderr || timeNow().Before(e.retryAt) {
+			return errFilesDown
+		}
+		e.failed = false
+	}
+	files := l.files.get()
+	top := s
+	if lowest := files.lowest(); top < lowest {
+		top = lowest
+	}
+	for f := top; f >= debugLog; f-- {
+		if !files.has(f) {
+			continue
+		}
+		if l.file[f] == nil {
+			if err := l.createFiles(f); err != nil {
+				return err
+			}
+		}
+		if _, err := l.file[f].Write(data); err != nil {
+			return err
+		}
+		if !l.fanout {
+			break
+		}
+	}
+	l.flushWritten(s, top)
+	return nil
+}
+
+// fileFlushed resets the backoff between attempts to create the log files
+// if err, the error of flushing or syncing one of them, is nil. Writes into
+// the buffers succeed long before the disk fails, so only this shows that
+// the files work again.
+// l.mu is held.
+func (l *loggingT) fileFlushed(err error) {
+	if err == nil {
+		l.fileErr.backoff = 0
+	}
+}
+
+// fileFailed applies -log_error_policy to data, a line of severity s which
+// could not be written to the log files because of err. wroteStderr reports
+// whether the line was written to standard error already.
+// l.mu is held.
+func (l *loggingT) fileFailed(err error, s severity, data []byte, wroteStderr bool) {
+	policy := l.errorPolicy.get()
+	if err != errFilesDown {
+		if policy == errorExit && !wroteStderr {
+			os.Stderr.Write(data) // Make sure the message appears somewhere.
+		}
+		if !l.filesFailed(err) {
+			return
+		}
+	}
+	if policy == errorDrop {
+		if stats := severityStats[s]; stats != nil {
+			atomic.AddInt64(&stats.dropped, 1)
+		}
+	} else if !wroteStderr {
+		os.Stderr.Write(data)
+	}
+}
+
+// filesFailed applies -log_error_policy to the log files after err, an error
+// creating or writing them: it either exits or gives up on the files until
+// the next attempt to create them. It returns false if it exited.
+// l.mu is held.
+func (l *loggingT) filesFailed(err error) bool {
+	atomic.AddInt64(&Stats.FileErrors, 1)
+	if l.onFileError != nil {
+		l.onFileError(err)
+	}
+	policy := l.errorPolicy.get()
+	if policy == errorExit {
+		l.exit(err)
+		return false
+	}
+	l.closeFiles()
+	e := &l.fileErr
+	e.failed = true
+	if e.backoff < minFileRetry {
+		e.backoff = minFileRetry
+	} else if e.backoff *= 2; e.backoff > maxFileRetry {
+		e.backoff = maxFileRetry
+	}
+	e.retryAt = timeNow().Add(e.backoff)
+	fmt.Fprintf(os.Stderr, "log: giving up on log files (-log_error_policy=%s): %s\n", errorPolicyName[policy], err)
+	return true
+}
+
+// closeFiles closes the log files, discarding whatever they could not write,
+// so that they are created anew on the next attempt.
+// l.mu is held.
+func (l *loggingT) closeFiles() {
+	for s := range l.file {
+		if c, ok := l.file[s].(io.Closer); ok {
+			c.Close() // ignore error
+		}
+		l.file[s] = nil
+	}
+}
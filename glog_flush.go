@@ -0,0 +1,156 @@
+package lg
+
+import (
+	"errors"
+	"flag"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// flushInterval is the period of the flushDaemon. It implements the
+// flag.Value interface and is handled atomically.
+type flushInterval int64
+
+// get returns the value of the flushInterval.
+func (d *flushInterval) get() time.Duration {
+	return time.Duration(atomic.LoadInt64((*int64)(d)))
+}
+
+// String is part of the flag.Value interface.
+func (d *flushInterval) String() string {
+	return d.get().String()
+}
+
+// Get is part of the flag.Getter interface.
+func (d *flushInterval) Get() interface{} {
+	return d.get()
+}
+
+var errFlushIntervalSyntax = errors.New("syntax error: expect a positive duration")
+
+// Set is part of the flag.Value interface.
+// Syntax: -log_flush_interval=5s
+func (d *flushInterval) Set(value string) error {
+	v, err := time.ParseDuration(value)
+	if err != nil || v <= 0 {
+		return errFlushIntervalSyntax
+	}
+	atomic.StoreInt64((*int64)(d), int64(v))
+	// Wake the flushDaemon so that it does not wait out the previous interval.
+	select {
+	case flushIntervalChanged <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// flushIntervalChanged is signalled when the -log_flush_interval flag is set.
+var flushIntervalChanged = make(chan struct{}, 1)
+
+// fsyncPolicy selects when log files are synced to disk. It implements the
+// flag.Value interface and is handled atomically. A positive value syncs each
+// file after that many bytes have been written to it.
+type fsyncPolicy int64
+
+const (
+	fsyncOnFlush fsyncPolicy = 0  // sync whenever the files are flushed
+	fsyncNever   fsyncPolicy = -1 // leave it to the operating system
+	fsyncOnError fsyncPolicy = -2 // sync after every ERROR and FATAL line
+)
+
+// get returns the value of the fsyncPolicy.
+func (p *fsyncPolicy) get() fsyncPolicy {
+	return fsyncPolicy(atomic.LoadInt64((*int64)(p)))
+}
+
+// String is part of the flag.Value interface.
+func (p *fsyncPolicy) String() string {
+	switch v := p.get(); v {
+	case fsyncOnFlush:
+		return "flush"
+	case fsyncNever:
+		return "never"
+	case fsyncOnError:
+		return "error"
+	default:
+		return strconv.FormatInt(int64(v), 10)
+	}
+}
+
+// Get is part of the flag.Getter interface.
+func (p *fsyncPolicy) Get() interface{} {
+	return p.get()
+}
+
+var errFsyncSyntax = errors.New("syntax error: expect one of never, flush, error or a positive number of bytes")
+
+// Set is part of the flag.Value interface.
+// Syntax: -log_fsync=error or -log_fsync=1048576
+func (p *fsyncPolicy) Set(value string) error {
+	var v fsyncPolicy
+	switch value {
+	case "flush":
+		v = fsyncOnFlush
+	case "never":
+		v = fsyncNever
+	case "error":
+		v = fsyncOnError
+	default:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || n <= 0 {
+			return errFsyncSyntax
+		}
+		v = fsyncPolicy(n)
+	}
+	atomic.StoreInt64((*int64)(p), int64(v))
+	return nil
+}
+
+func init() {
+	flag.Var(&logging.flushInterval, "log_flush_interval", "how often buffered log lines are flushed to the log files")
+	flag.Var(&logging.flushSeverity, "log_flush_severity", "log lines at or above this severity flush the log files immediately")
+	flag.Var(&logging.fsync, "log_fsync", "when to sync the log files to disk: never, flush, error (after every ERROR line) or a number of bytes written")
+}
+
+// SetFlushInterval sets how often buffered log lines are flushed to the log
+// files, as the -log_flush_interval flag does. It returns an error if d is not
+// positive.
+func SetFlushInterval(d time.Duration) error {
+	return logging.flushInterval.Set(d.String())
+}
+
+// SetFlushSeverity makes log lines of the named severity and above flush the
+// log files immediately, as the -log_flush_severity flag does. Valid names are
+// "DEBUG", "INFO", "NOTICE", "WARNING", "ERROR", "CRITICAL" and "FATAL".
+func SetFlushSeverity(name string) error {
+	return logging.flushSeverity.Set(name)
+}
+
+// SetFsync sets when the log files are synced to disk, as the -log_fsync flag
+// does. The policy is one of "never", "flush" (the default), "error" or a
+// positive number of bytes.
+func SetFsync(policy string) error {
+	return logging.fsync.Set(policy)
+}
+
+// flushWritten applies -log_flush_severity and -log_fsync to the log files
+// from top down, which a line of severity s was just written to.
+// l.mu is held.
+func (l *loggingT) flushWritten(s, top severity) {
+	sync := s >= errorLog && l.fsync.get() == fsyncOnError
+	if !sync && s < l.flushSeverity.get() {
+		return
+	}
+	for s = top; s >= debugLog; s-- {
+		if file := l.file[s]; file != nil {
+			err := file.Flush()
+			if sync {
+				if serr := file.Sync(); err == nil {
+					err = serr
+				}
+			}
+			l.fileFlushed(err)
+		}
+	}
+}
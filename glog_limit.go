@@ -0,0 +1,165 @@
+package lg
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limited is returned by Every, FirstN and Sample and implements the Info,
+// Warning and Error methods (and their ln/f variants), which log only if the
+// call site's limit allows it. When a call site logs again after messages
+// were suppressed, the number of suppressed messages is appended to the line.
+type Limited struct {
+	ok         bool
+	suppressed int64
+}
+
+// limitState is the per call site state of Every, FirstN and Sample.
+type limitState struct {
+	calls      int64     // The number of calls made
+	suppressed int64     // The number of calls suppressed since the last one that logged
+	last       time.Time // The time of the last call that logged
+}
+
+// limits maps the PC of each Every, FirstN and Sample call site to its state.
+// It is separate from logging.mu so that limited call sites do not contend
+// with output.
+var limits struct {
+	sync.Mutex
+	m map[uintptr]*limitState
+}
+
+// limit looks up the state of the call site of Every, FirstN or Sample and
+// reports whether allow lets it log.
+func limit(allow func(st *limitState, now time.Time) bool) Limited {
+	var pcs [1]uintptr
+	if runtime.Callers(3, pcs[:]) == 0 {
+		return Limited{ok: true}
+	}
+	now := timeNow()
+	limits.Lock()
+	defer limits.Unlock()
+	st, ok := limits.m[pcs[0]]
+	if !ok {
+		if limits.m == nil {
+			limits.m = make(map[uintptr]*limitState)
+		}
+		st = &limitState{}
+		limits.m[pcs[0]] = st
+	}
+	ok = allow(st, now)
+	st.calls++
+	if !ok {
+		st.suppressed++
+		return Limited{}
+	}
+	r := Limited{ok: true, suppressed: st.suppressed}
+	st.suppressed = 0
+	st.last = now
+	return r
+}
+
+// Every reports whether the call site has not logged during the last d and
+// thus may log now. Call sites are identified by PC, as in V:
+//
+//	lg.Every(time.Second).Warningf("retrying: %v", err)
+func Every(d time.Duration) Limited {
+	return limit(func(st *limitState, now time.Time) bool {
+		return st.calls == 0 || now.Sub(st.last) >= d
+	})
+}
+
+// FirstN reports whether the call site has been called fewer than n times.
+func FirstN(n int) Limited {
+	return limit(func(st *limitState, now time.Time) bool {
+		return st.calls < int64(n)
+	})
+}
+
+// Sample reports whether the call site may log, which is the case for one in
+// every k calls starting with the first one.
+func Sample(k int) Limited {
+	return limit(func(st *limitState, now time.Time) bool {
+		return k <= 1 || st.calls%int64(k) == 0
+	})
+}
+
+// printLimited logs text, noting the number of suppressed messages if any.
+func (l *loggingT) printLimited(s severity, suppressed int64, text string) {
+	if l.discards(s) {
+		return
+	}
+	buf, file, line, pc := l.header(s, 0)
+	buf.WriteString(strings.TrimSuffix(text, "\n"))
+	if suppressed > 0 {
+		fmt.Fprintf(buf, " (suppressed %d messages)", suppressed)
+	}
+	buf.WriteByte('\n')
+	l.output(s, buf, pc, file, line, false)
+}
+
+// Info is equivalent to the global Info function, guarded by the limit.
+func (r Limited) Info(args ...interface{}) {
+	if r.ok {
+		logging.printLimited(infoLog, r.suppressed, fmt.Sprint(args...))
+	}
+}
+
+// Infoln is equivalent to the global Infoln function, guarded by the limit.
+func (r Limited) Infoln(args ...interface{}) {
+	if r.ok {
+		logging.printLimited(infoLog, r.suppressed, fmt.Sprintln(args...))
+	}
+}
+
+// Infof is equivalent to the global Infof function, guarded by the limit.
+func (r Limited) Infof(format string, args ...interface{}) {
+	if r.ok {
+		logging.printLimited(infoLog, r.suppressed, fmt.Sprintf(format, args...))
+	}
+}
+
+// Warning is equivalent to the global Warning function, guarded by the limit.
+func (r Limited) Warning(args ...interface{}) {
+	if r.ok {
+		logging.printLimited(warningLog, r.suppressed, fmt.Sprint(args...))
+	}
+}
+
+// Warningln is equivalent to the global Warningln function, guarded by the limit.
+func (r Limited) Warningln(args ...interface{}) {
+	if r.ok {
+		logging.printLimited(warningLog, r.suppressed, fmt.Sprintln(args...))
+	}
+}
+
+// Warningf is equivalent to the global Warningf function, guarded by the limit.
+func (r Limited) Warningf(format string, args ...interface{}) {
+	if r.ok {
+		logging.printLimited(warningLog, r.suppressed, fmt.Sprintf(format, args...))
+	}
+}
+
+// Error is equivalent to the global Error function, guarded by the limit.
+func (r Limited) Error(args ...interface{}) {
+	if r.ok {
+		logging.printLimited(errorLog, r.suppressed, fmt.Sprint(args...))
+	}
+}
+
+// Errorln is equivalent to the global Errorln function, guarded by the limit.
+func (r Limited) Errorln(args ...interface{}) {
+	if r.ok {
+		logging.printLimited(errorLog, r.suppressed, fmt.Sprintln(args...))
+	}
+}
+
+// Errorf is equivalent to the global Errorf function, guarded by the limit.
+func (r Limited) Errorf(format string, args ...interface{}) {
+	if r.ok {
+		logging.printLimited(errorLog, r.suppressed, fmt.Sprintf(format, args...))
+	}
+}
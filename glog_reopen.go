@@ -0,0 +1,74 @@
+package lg
+
+import (
+	"flag"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+)
+
+func init() {
+	flag.BoolVar(&logging.reopenOnHup, "log_reopen_on_sighup", false, "reopen the log files when the process receives SIGHUP, for use with logrotate")
+}
+
+// Reopen closes the log files and creates them again, under the same names
+// with -log_stable_names and with new timestamped names otherwise. A file
+// whose new name would be its current one, as when Reopen is called within a
+// second of creating it, is kept open. Reopen lets external tools such as
+// logrotate move or truncate the files. It returns the first error
+// encountered, if any.
+func Reopen() error {
+	return logging.reopen()
+}
+
+// reopen implements Reopen.
+func (l *loggingT) reopen() error {
+	l.mu.Lock()
+	if atomic.LoadUint32(&l.closed) != 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	l.flushRepeated()
+	repeats := l.takeRepeated()
+	now := timeNow()
+	var firstErr error
+	for s := fatalLog; s >= debugLog; s-- {
+		sb, ok := l.file[s].(*syncBuffer)
+		if !ok {
+			continue
+		}
+		if err := sb.rotateFile(now); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	l.mu.Unlock()
+	l.sinkRepeated(repeats)
+	return firstErr
+}
+
+// ReopenOnSignal calls Reopen whenever the process receives one of sigs, or
+// SIGHUP if none are given. Errors are handled according to
+// -log_error_policy, as errors writing the log files are.
+func ReopenOnSignal(sigs ...os.Signal) {
+	if len(sigs) == 0 {
+		sigs = []os.Signal{syscall.SIGHUP}
+	}
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, sigs...)
+	go func() {
+		for range c {
+			logging.reopenOrFail()
+		}
+	}()
+}
+
+// reopenOrFail reopens the log files, applying -log_error_policy if that
+// fails.
+func (l *loggingT) reopenOrFail() {
+	if err := l.reopen(); err != nil {
+		l.mu.Lock()
+		l.filesFailed(err)
+		l.mu.Unlock()
+	}
+}
@@ -0,0 +1,151 @@
+package lg
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Record is a log line in structured form, as passed to a Sink.
+type Record struct {
+	Time     time.Time
+	Severity string  // The severity name, such as "INFO"
+	File     string  // The file name, as printed according to -log_source
+	Line     int     // The line number
+	Func     string  // The fully qualified function name, if known
+	Message  string  // The message, without fields or trailing newline
+	Fields   []Field // The fields of an Event, or of a context and the context hooks
+	Text     []byte  // The line as written to the log files, ending with a newline
+}
+
+// Sink receives the lines logged, in addition to the log files. Emit is
+// called concurrently, without the logging lock held, and must not log. The
+// record and its slices are not modified after Emit is called, so a sink may
+// keep them, but must not modify them itself.
+type Sink interface {
+	// Emit handles a record, typically by queueing it.
+	Emit(r *Record) error
+	// Flush writes what the sink has queued. It is called by Flush.
+	Flush() error
+	// Close flushes and releases the sink. It is called by Shutdown.
+	Close() error
+}
+
+// sinkEntry is a registered Sink and the lowest severity it receives.
+type sinkEntry struct {
+	sink Sink
+	min  severity
+}
+
+// sinks are the sinks registered with AddSink. The number of sinks is
+// handled atomically so that logging without sinks only costs a load.
+var sinks struct {
+	sync.RWMutex
+	list []sinkEntry
+	n    int32
+}
+
+// AddSink registers sink to receive the lines of the named severity and
+// above. Valid names are "DEBUG", "INFO", "NOTICE", "WARNING", "ERROR",
+// "CRITICAL" and "FATAL".
+func AddSink(sink Sink, name string) error {
+	min, ok := severityByName(name)
+	if !ok {
+		return fmt.Errorf("lg.AddSink: unrecognized severity name %q", name)
+	}
+	sinks.Lock()
+	sinks.list = append(sinks.list, sinkEntry{sink, min})
+	atomic.StoreInt32(&sinks.n, int32(len(sinks.list)))
+	sinks.Unlock()
+	return nil
+}
+
+// RemoveSink unregisters sink, without closing it. It reports whether sink
+// was registered.
+func RemoveSink(sink Sink) bool {
+	sinks.Lock()
+	defer sinks.Unlock()
+	for i, e := range sinks.list {
+		if e.sink == sink {
+			sinks.list = append(sinks.list[:i:i], sinks.list[i+1:]...)
+			atomic.StoreInt32(&sinks.n, int32(len(sinks.list)))
+			return true
+		}
+	}
+	return false
+}
+
+// hasSinks reports whether any sink is registered.
+func hasSinks() bool {
+	return atomic.LoadInt32(&sinks.n) > 0
+}
+
+// toSinks passes the line in buf, of severity s, to the sinks which receive
+// it.
+func (l *loggingT) toSinks(s severity, buf *buffer, pc uintptr, file string, line int) {
+	if !hasSinks() {
+		return
+	}
+	var r *Record
+	sinks.RLock()
+	defer sinks.RUnlock()
+	for _, e := range sinks.list {
+		if s < e.min {
+			continue
+		}
+		if r == nil {
+			r = buf.record(s, pc, file, line)
+		}
+		if err := e.sink.Emit(r); err != nil {
+			atomic.AddInt64(&Stats.SinkErrors, 1)
+		}
+	}
+}
+
+// record returns the line in buf as a Record.
+func (buf *buffer) record(s severity, pc uintptr, file string, line int) *Record {
+	data := buf.Bytes()
+	r := &Record{
+		Time:     buf.time,
+		Severity: severityName[s],
+		File:     file,
+		Line:     line,
+		Fields:   buf.fields,
+		Text:     append([]byte(nil), data...),
+	}
+	if buf.msg <= buf.msgEnd && buf.msgEnd <= len(data) {
+		r.Message = string(data[buf.msg:buf.msgEnd])
+	}
+	if pc != 0 {
+		r.Func = lookupCallerLoc(pc).function
+	}
+	return r
+}
+
+// flushSinks flushes all sinks.
+func flushSinks() {
+	sinks.RLock()
+	defer sinks.RUnlock()
+	for _, e := range sinks.list {
+		if err := e.sink.Flush(); err != nil {
+			atomic.AddInt64(&Stats.SinkErrors, 1)
+		}
+	}
+}
+
+// closeSinks unregisters and closes all sinks, returning the first error.
+func closeSinks() error {
+	sinks.Lock()
+	list := sinks.list
+	sinks.list = nil
+	atomic.StoreInt32(&sinks.n, 0)
+	sinks.Unlock()
+	var firstErr error
+	for _, e := range list {
+		if err := e.sink.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,210 @@
+package lg
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// sourceMode selects how the source file of a log line is printed in the
+// header. It implements the flag.Value interface and is handled atomically.
+type sourceMode int32
+
+const (
+	sourceBase    sourceMode = iota // file basename: server.go
+	sourcePath                      // path relative to the module root: rpc/server.go
+	sourcePackage                   // package import path and file: github.com/acme/x/rpc/server.go
+)
+
+var sourceModeName = []string{
+	sourceBase:    "base",
+	sourcePath:    "path",
+	sourcePackage: "package",
+}
+
+// get returns the value of the sourceMode.
+func (m *sourceMode) get() sourceMode {
+	return sourceMode(atomic.LoadInt32((*int32)(m)))
+}
+
+// String is part of the flag.Value interface.
+func (m *sourceMode) String() string {
+	if v := m.get(); v >= 0 && int(v) < len(sourceModeName) {
+		return sourceModeName[v]
+	}
+	return strconv.Itoa(int(*m))
+}
+
+// Get is part of the flag.Getter interface.
+func (m *sourceMode) Get() interface{} {
+	return m.get()
+}
+
+var errSourceSyntax = errors.New("syntax error: expect one of base, path or package")
+
+// Set is part of the flag.Value interface.
+// Syntax: -log_source=package
+func (m *sourceMode) Set(value string) error {
+	for i, name := range sourceModeName {
+		if name == value {
+			atomic.StoreInt32((*int32)(m), int32(i))
+			return nil
+		}
+	}
+	return errSourceSyntax
+}
+
+func init() {
+	flag.Var(&logging.source, "log_source", "source file format in log lines: base, path (relative to the module root) or package (import path)")
+	flag.BoolVar(&logging.withFunc, "log_func", false, "include the calling function name in log lines")
+}
+
+// callerLoc caches the location of a call site, so that logging does not
+// need to symbolize its PC every time.
+type callerLoc struct {
+	file     string // base name of the file
+	line     int
+	function string // fully qualified function name
+	path     string // file relative to its module root
+	pkg      string // file prefixed by the package import path
+	fn       string // function name qualified by the package name
+}
+
+// callerLocs maps PCs to their computed locations.
+var callerLocs struct {
+	sync.RWMutex
+	m map[uintptr]*callerLoc
+}
+
+// caller returns the location and PC of the call site identified by depth, as
+// in runtime.Caller(depth). Unlike runtime.Caller, it does not allocate once
+// the location is cached.
+func caller(depth int) (*callerLoc, uintptr) {
+	var pcs [1]uintptr
+	if runtime.Callers(depth+2, pcs[:]) == 0 {
+		return nil, 0
+	}
+	return lookupCallerLoc(pcs[0]), pcs[0]
+}
+
+// location returns the file name to print for loc, and the function name if
+// -log_func is set.
+func (l *loggingT) location(loc *callerLoc) (string, string) {
+	var fn string
+	if l.withFunc {
+		fn = loc.fn
+	}
+	switch l.source.get() {
+	case sourcePath:
+		return loc.path, fn
+	case sourcePackage:
+		return loc.pkg, fn
+	}
+	return loc.file, fn
+}
+
+// lookupCallerLoc returns the cached location for pc, as returned by
+// runtime.Callers, computing it if needed.
+func lookupCallerLoc(pc uintptr) *callerLoc {
+	callerLocs.RLock()
+	loc, ok := callerLocs.m[pc]
+	callerLocs.RUnlock()
+	if ok {
+		return loc
+	}
+	frame, _ := runtime.CallersFrames([]uintptr{pc}).Next()
+	loc = &callerLoc{
+		file:     filepath.Base(frame.File),
+		line:     frame.Line,
+		function: frame.Function,
+	}
+	if frame.File == "" {
+		loc.file = "???"
+		loc.line = 1
+	}
+	if loc.function == "" {
+		loc.function = "???"
+	}
+	loc.pkg = funcPackage(loc.function) + "/" + loc.file
+	loc.function = unescapeSymbol(loc.function)
+	loc.fn = loc.function[strings.LastIndex(loc.function, "/")+1:]
+	callerLocs.Lock()
+	defer callerLocs.Unlock()
+	if frame.File != "" {
+		if root := moduleRoot(filepath.Dir(frame.File)); root != "" {
+			if rel, err := filepath.Rel(root, frame.File); err == nil {
+				loc.path = filepath.ToSlash(rel)
+			}
+		}
+	}
+	if loc.path == "" {
+		loc.path = loc.pkg
+	}
+	if callerLocs.m == nil {
+		callerLocs.m = make(map[uintptr]*callerLoc)
+	}
+	callerLocs.m[pc] = loc
+	return loc
+}
+
+// funcPackage returns the package import path of a function name as returned
+// by runtime.Func.Name, for instance github.com/acme/x/rpc.(*Server).Handle
+// yields github.com/acme/x/rpc.
+func funcPackage(name string) string {
+	slash := strings.LastIndex(name, "/")
+	if dot := strings.Index(name[slash+1:], "."); dot >= 0 {
+		name = name[:slash+1+dot]
+	}
+	return unescapeSymbol(name)
+}
+
+// unescapeSymbol undoes the escaping of the last element of package paths in
+// symbol names, where the linker writes dots, percent signs, quotes and
+// control characters as %xx: gopkg.in/yaml%2ev3.Marshal is the Marshal
+// function of gopkg.in/yaml.v3.
+func unescapeSymbol(name string) string {
+	if !strings.Contains(name, "%") {
+		return name
+	}
+	b := make([]byte, 0, len(name))
+	for i := 0; i < len(name); i++ {
+		if name[i] == '%' && i+2 < len(name) {
+			if c, err := strconv.ParseUint(name[i+1:i+3], 16, 8); err == nil {
+				b = append(b, byte(c))
+				i += 2
+				continue
+			}
+		}
+		b = append(b, name[i])
+	}
+	return string(b)
+}
+
+// moduleRoots caches the module root of each source directory seen, the empty
+// string meaning that there is none.
+// callerLocs is locked when it is accessed.
+var moduleRoots = make(map[string]string)
+
+// moduleRoot returns the closest directory at or above dir which contains a
+// go.mod file, or the empty string if there is none. It only works when the
+// sources are available on the machine running the program, callers fall back
+// to the package import path otherwise.
+func moduleRoot(dir string) string {
+	if root, ok := moduleRoots[dir]; ok {
+		return root
+	}
+	var root string
+	if _, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil {
+		root = dir
+	} else if parent := filepath.Dir(dir); parent != dir {
+		root = moduleRoot(parent)
+	}
+	moduleRoots[dir] = root
+	return root
+}
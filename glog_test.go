@@ -18,12 +18,18 @@ package lg
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	stdLog "log"
+	"os"
 	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -67,7 +73,11 @@ func (l *loggingT) swap(writers [numSeverity]flushSyncWriter) (old [numSeverity]
 
 // newBuffers sets the log writers to all new byte buffers and returns the old array.
 func (l *loggingT) newBuffers() [numSeverity]flushSyncWriter {
-	return l.swap([numSeverity]flushSyncWriter{new(flushBuffer), new(flushBuffer), new(flushBuffer), new(flushBuffer)})
+	var writers [numSeverity]flushSyncWriter
+	for i := range writers {
+		writers[i] = new(flushBuffer)
+	}
+	return l.swap(writers)
 }
 
 // contents returns the specified log value as a string.
@@ -169,6 +179,24 @@ func TestStandardLog(t *testing.T) {
 	}
 }
 
+// Test that the memory log keeps the most recent lines in order.
+func TestMemlog(t *testing.T) {
+	memlog.Lock()
+	defer func(lines []string, next int) { memlog.lines, memlog.next = lines, next }(memlog.lines, memlog.next)
+	memlog.lines, memlog.next = nil, 0
+	memlog.Unlock()
+	for i := 0; i < memlogLength+10; i++ {
+		logToMemory([]byte(strconv.Itoa(i) + "\n"))
+	}
+	lines := Memlog()
+	if len(lines) != memlogLength {
+		t.Fatalf("got %d lines, want %d", len(lines), memlogLength)
+	}
+	if lines[0] != "10" || lines[len(lines)-1] != strconv.Itoa(memlogLength+9) {
+		t.Errorf("got lines %s...%s, want 10...%d", lines[0], lines[len(lines)-1], memlogLength+9)
+	}
+}
+
 // Test that the header has the correct format.
 func TestHeader(t *testing.T) {
 	setFlags()
@@ -193,6 +221,129 @@ func TestHeader(t *testing.T) {
 	}
 }
 
+// Test that the header can show the package import path and function name.
+func TestHeaderSource(t *testing.T) {
+	setFlags()
+	defer logging.swap(logging.newBuffers())
+	defer logging.source.Set("base")
+	defer func(previous bool) { logging.withFunc = previous }(logging.withFunc)
+	logging.source.Set("package")
+	logging.withFunc = true
+	Info("test")
+	want := "github.com/thomasf/lg/glog_test.go:"
+	if !contains(infoLog, want, t) {
+		t.Errorf("log source error: got %q, want %q", contents(infoLog), want)
+	}
+	want = " lg.TestHeaderSource] test\n"
+	if !strings.HasSuffix(contents(infoLog), want) {
+		t.Errorf("log func error: got %q, want suffix %q", contents(infoLog), want)
+	}
+	if err := logging.source.Set("dir"); err == nil {
+		t.Error("log_source accepted an unknown mode")
+	}
+}
+
+// Test that source paths are made relative to the closest go.mod.
+func TestModuleRoot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lgmod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.MkdirAll(filepath.Join(dir, "x", "rpc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "x", "go.mod"), []byte("module x\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	callerLocs.Lock()
+	defer callerLocs.Unlock()
+	if got, want := moduleRoot(filepath.Join(dir, "x", "rpc")), filepath.Join(dir, "x"); got != want {
+		t.Errorf("moduleRoot: got %q, want %q", got, want)
+	}
+	if got := moduleRoot(dir); got != "" {
+		t.Errorf("moduleRoot outside module: got %q, want none", got)
+	}
+}
+
+func TestFuncPackage(t *testing.T) {
+	for _, test := range []struct{ name, pkg string }{
+		{"main.main", "main"},
+		{"github.com/acme/x/rpc.(*Server).Handle", "github.com/acme/x/rpc"},
+		{"gopkg.in/yaml%2ev3.Marshal", "gopkg.in/yaml.v3"},
+		{"example.com/c%2ed.(*T).M.func1", "example.com/c.d"},
+	} {
+		if got := funcPackage(test.name); got != test.pkg {
+			t.Errorf("funcPackage(%q): got %q, want %q", test.name, got, test.pkg)
+		}
+	}
+	if got, want := unescapeSymbol("gopkg.in/yaml%2ev3.Marshal"), "gopkg.in/yaml.v3.Marshal"; got != want {
+		t.Errorf("unescapeSymbol: got %q, want %q", got, want)
+	}
+}
+
+// Test that colored standard error output copes with long locations.
+func TestColorLocation(t *testing.T) {
+	setFlags()
+	defer logging.swap(logging.newBuffers())
+	defer logging.source.Set("base")
+	defer func(previous bool) { logging.withFunc = previous }(logging.withFunc)
+	defer func(previous bool) { logging.color = previous }(logging.color)
+	defer func(previous *os.File) { os.Stderr = previous }(os.Stderr)
+	f, err := ioutil.TempFile("", "lgstderr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	os.Stderr = f
+	// The escape codes go to standard output, keep them out of the test output.
+	defer os.Setenv("TERM", os.Getenv("TERM"))
+	os.Setenv("TERM", "dumb")
+	logging.color = true
+	logging.source.Set("package")
+	logging.withFunc = true
+	Error("colored")
+	data, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"github.com/thomasf/lg/glog_test.go", "lg.TestColorLocation", "] colored\n"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("colored output %q is missing %q", data, want)
+		}
+	}
+}
+
+// Test that SetStderr(false) keeps lines off standard error.
+func TestSetStderr(t *testing.T) {
+	setFlags()
+	defer logging.swap(logging.newBuffers())
+	defer SetStderr(true)
+	defer func(previous *os.File) { os.Stderr = previous }(os.Stderr)
+	f, err := ioutil.TempFile("", "lgstderr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	os.Stderr = f
+	SetStderr(false)
+	Error("hidden")
+	SetStderr(true)
+	Error("shown")
+	data, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "hidden") || !strings.Contains(string(data), "] shown\n") {
+		t.Errorf("unexpected standard error output %q", data)
+	}
+	if !contains(errorLog, "] hidden\n", t) {
+		t.Errorf("line missing from the ERROR log: %q", contents(errorLog))
+	}
+}
+
 // Test that an Error log goes to Warning and Info.
 // Even in the Info log, the source character will be E, so the data should
 // all be identical.
@@ -273,6 +424,96 @@ func TestVmoduleOn(t *testing.T) {
 	}
 }
 
+// Test that V does not lock for call sites it has seen before.
+func TestVmoduleSeenUnlocked(t *testing.T) {
+	setFlags()
+	logging.vmodule.Set("glog_test=2")
+	defer logging.vmodule.Set("")
+	done := make(chan Verbose)
+	for i := 0; i < 2; i++ {
+		if i == 1 {
+			logging.vmu.Lock()
+			defer logging.vmu.Unlock()
+		}
+		go func() { done <- V(2) }()
+		select {
+		case v := <-done:
+			if !v {
+				t.Error("V not enabled for 2")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("V waited for the lock")
+		}
+	}
+}
+
+// Test that VDepth checks -vmodule against the caller's file.
+func TestVDepth(t *testing.T) {
+	setFlags()
+	defer logging.swap(logging.newBuffers())
+	// The caller of a test function is in testing.go.
+	logging.vmodule.Set("testing=2")
+	defer logging.vmodule.Set("")
+	if V(2) || VDepth(0, 2) {
+		t.Error("V enabled for glog_test")
+	}
+	if !VDepth(1, 2) {
+		t.Error("VDepth not enabled for testing")
+	}
+	VDepth(1, 2).Warning("warning")
+	VDepth(1, 2).Errorf("error %d", 1)
+	V(2).Error("off")
+	if !contains(warningLog, "] warning", t) || !contains(errorLog, "] error 1", t) {
+		t.Error("Verbose Warning or Errorf failed")
+	}
+	if contains(errorLog, "off", t) {
+		t.Error("Verbose Error logged while V is off")
+	}
+	VDepth(1, 2).InfoDepth(0, "depth")
+	if !contains(infoLog, "glog_test.go:", t) || !contains(infoLog, "] depth", t) {
+		t.Errorf("Verbose InfoDepth has wrong location: %q", contents(infoLog))
+	}
+}
+
+// Test that a context carrying a verbosity or vmodule override enables V
+// logging for the calls made with it only.
+func TestVCtx(t *testing.T) {
+	setFlags()
+	defer logging.swap(logging.newBuffers())
+	ctx := context.Background()
+	if VCtx(ctx, 1) {
+		t.Error("VCtx enabled without override")
+	}
+	vctx := WithVerbosity(ctx, 2)
+	if !VCtx(vctx, 2) || VCtx(vctx, 3) {
+		t.Error("VCtx does not follow WithVerbosity")
+	}
+	mctx, err := WithVmodule(ctx, "glog_test=3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !VCtx(mctx, 3) || VCtx(mctx, 4) {
+		t.Error("VCtx does not follow WithVmodule")
+	}
+	if other, _ := WithVmodule(ctx, "notthisfile=3"); VCtx(other, 1) {
+		t.Error("VCtx enabled by vmodule of another file")
+	}
+	if both := WithVerbosity(mctx, 1); !VCtx(both, 3) {
+		t.Error("WithVerbosity dropped the vmodule override")
+	}
+	if _, err := WithVmodule(ctx, "glog_test"); err == nil {
+		t.Error("WithVmodule accepted a bad spec")
+	}
+	VCtx(mctx, 3).Info("request")
+	V(3).Info("global")
+	if !contains(infoLog, "] request", t) || contains(infoLog, "global", t) {
+		t.Errorf("VCtx logged incorrectly: %q", contents(infoLog))
+	}
+	if V(1) {
+		t.Error("context override changed the global verbosity")
+	}
+}
+
 // Test that a vmodule of another file does not enable a log in this file.
 func TestVmoduleOff(t *testing.T) {
 	setFlags()
@@ -326,6 +567,1055 @@ func TestVmoduleGlob(t *testing.T) {
 	}
 }
 
+// vPaths are patterns containing a slash that match/don't match this file at V=2.
+var vPaths = map[string]bool{
+	"github.com/thomasf/lg=2":             true,
+	"github.com/thomasf/lg/*=2":           true,
+	"github.com/thomasf/lg/glog_test=2":   true,
+	"github.com/thomasf/**=2":             true,
+	"github.com/**/glog_test=2":           true,
+	"**/lg/glog_test=2":                   true,
+	"github.com/thomasf/lg/glog=2":        false,
+	"github.com/thomasf/lg/pkg/**=2":      false,
+	"github.com/other/**=2":               false,
+	"thomasf/lg/*=2":                      false,
+	"github.com/thomasf/lg/glog_test/x=2": false,
+}
+
+// Test that vmodule patterns with a slash match package paths.
+func TestVmodulePath(t *testing.T) {
+	for pat, match := range vPaths {
+		testVmoduleGlob(pat, match, t)
+	}
+}
+
+// Test that Every, FirstN and Sample limit each call site separately.
+func TestLimited(t *testing.T) {
+	setFlags()
+	defer logging.swap(logging.newBuffers())
+	defer func(previous func() time.Time) { timeNow = previous }(timeNow)
+	now := time.Date(2006, 1, 2, 15, 4, 5, 0, time.Local)
+	timeNow = func() time.Time { return now }
+	limits.Lock()
+	limits.m = nil
+	limits.Unlock()
+	for i := 0; i < 10; i++ {
+		Every(time.Minute).Infof("every %d", i)
+		FirstN(3).Warningln("first", i)
+		Sample(4).Error("sample ", i)
+		now = now.Add(10 * time.Second)
+	}
+	for _, want := range []string{
+		"] every 0\n",
+		"] every 6 (suppressed 5 messages)\n",
+		"] first 0\n",
+		"] first 2\n",
+		"] sample 0\n",
+		"] sample 4 (suppressed 3 messages)\n",
+		"] sample 8 (suppressed 3 messages)\n",
+	} {
+		if !contains(infoLog, want, t) {
+			t.Errorf("missing %q in log: %s", want, contents(infoLog))
+		}
+	}
+	if n := strings.Count(contents(infoLog), "\n"); n != 2+3+3 {
+		t.Errorf("got %d lines, want 8: %s", n, contents(infoLog))
+	}
+	if n := strings.Count(contents(errorLog), "\n"); n != 3 {
+		t.Errorf("got %d error lines, want 3: %s", n, contents(errorLog))
+	}
+}
+
+// Test that identical consecutive lines are collapsed by -log_dedup.
+func TestDedup(t *testing.T) {
+	setFlags()
+	defer logging.swap(logging.newBuffers())
+	defer func(previous time.Duration) { logging.dedupWindow = previous }(logging.dedupWindow)
+	defer func(previous func() time.Time) { timeNow = previous }(timeNow)
+	now := time.Date(2006, 1, 2, 15, 4, 5, 0, time.Local)
+	timeNow = func() time.Time { return now }
+	logging.dedupWindow = time.Minute
+	for i := 0; i < 5; i++ {
+		Error("retrying")
+		now = now.Add(time.Second)
+	}
+	Error("retrying", 1)
+	for i := 0; i < 3; i++ {
+		Warning("slow")
+		now = now.Add(time.Minute)
+	}
+	Warning("slow")
+	Flush()
+	lines := strings.Split(strings.TrimSuffix(contents(infoLog), "\n"), "\n")
+	want := []string{
+		"] retrying",
+		"] last message repeated 4 times",
+		"] retrying1",
+		"] slow",
+		"] slow",
+		"] slow",
+		"] slow",
+	}
+	if len(lines) != len(want) {
+		t.Fatalf("got %d lines, want %d: %s", len(lines), len(want), contents(infoLog))
+	}
+	for i, w := range want {
+		if !strings.HasSuffix(lines[i], w) {
+			t.Errorf("line %d: got %q, want suffix %q", i, lines[i], w)
+		}
+	}
+	if contents(errorLog) != strings.Join(lines[:3], "\n")+"\n" {
+		t.Errorf("error log differs from info log: %s", contents(errorLog))
+	}
+
+	// The repeat count reaches the sinks too.
+	sink := &memSink{}
+	if err := AddSink(sink, "INFO"); err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveSink(sink)
+	for i := 0; i < 3; i++ {
+		Info("again")
+	}
+	Info("done")
+	var msgs []string
+	for _, r := range sink.records {
+		msgs = append(msgs, r.Message)
+	}
+	if got, want := strings.Join(msgs, "|"), "again|last message repeated 2 times|done"; got != want {
+		t.Errorf("sink got %q, want %q", got, want)
+	}
+}
+
+// startAsync enables -log_async with a new queue and returns a function
+// restoring synchronous logging.
+func startAsync(size int, policy string) func() {
+	logging.mu.Lock()
+	logging.async = nil
+	logging.asyncOnce = sync.Once{}
+	logging.asyncSize = size
+	logging.asyncOverflow.Set(policy)
+	logging.mu.Unlock()
+	return func() {
+		Flush()
+		logging.mu.Lock()
+		logging.asyncSize = 0
+		logging.mu.Unlock()
+	}
+}
+
+// Test that -log_async writes every line in order.
+func TestAsync(t *testing.T) {
+	setFlags()
+	defer logging.swap(logging.newBuffers())
+	defer startAsync(4, "block")()
+	for i := 0; i < 100; i++ {
+		Infof("async %d", i)
+	}
+	Flush()
+	lines := strings.Split(strings.TrimSuffix(contents(infoLog), "\n"), "\n")
+	if len(lines) != 100 {
+		t.Fatalf("got %d lines, want 100", len(lines))
+	}
+	for i, line := range lines {
+		if want := fmt.Sprintf("] async %d", i); !strings.HasSuffix(line, want) {
+			t.Errorf("line %d: got %q, want suffix %q", i, line, want)
+		}
+	}
+}
+
+// slowBuffer is a flushSyncWriter whose writes take a while.
+type slowBuffer struct {
+	discard
+}
+
+func (slowBuffer) Write(p []byte) (int, error) {
+	time.Sleep(50 * time.Microsecond)
+	return len(p), nil
+}
+
+// Test that Flush returns while other goroutines keep the -log_async queue
+// full.
+func TestAsyncFlushUnderLoad(t *testing.T) {
+	setFlags()
+	var files [numSeverity]flushSyncWriter
+	for s := range files {
+		files[s] = slowBuffer{}
+	}
+	defer logging.swap(logging.swap(files))
+	defer startAsync(100, "block")()
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					Info("load")
+				}
+			}
+		}()
+	}
+	defer func() {
+		close(stop)
+		wg.Wait()
+	}()
+	time.Sleep(10 * time.Millisecond)
+	flushed := make(chan struct{})
+	go func() {
+		Flush()
+		close(flushed)
+	}()
+	select {
+	case <-flushed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Flush blocked while the queue was kept full")
+	}
+}
+
+// testAsyncOverflow fills a queue of two lines while the writer is stuck and
+// checks which lines were written.
+func testAsyncOverflow(t *testing.T, policy string, want []string) {
+	setFlags()
+	defer logging.swap(logging.newBuffers())
+	defer startAsync(2, policy)()
+	dropped := Stats.Warning.Dropped()
+	logging.mu.Lock()
+	Warning("w0")
+	// Wait for the writer to take w0 and block on the lock.
+	q := logging.asyncQueue()
+	for {
+		q.mu.Lock()
+		busy := q.busy
+		q.mu.Unlock()
+		if busy {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for i := 1; i <= 4; i++ {
+		Warningf("w%d", i)
+	}
+	logging.mu.Unlock()
+	Flush()
+	if Stats.Warning.Dropped()-dropped != 2 {
+		t.Errorf("%s: got %d dropped lines, want 2", policy, Stats.Warning.Dropped()-dropped)
+	}
+	var got []string
+	for _, line := range strings.Split(strings.TrimSuffix(contents(warningLog), "\n"), "\n") {
+		got = append(got, line[strings.LastIndex(line, " ")+1:])
+	}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("%s: got lines %v, want %v", policy, got, want)
+	}
+}
+
+func TestAsyncDropOldest(t *testing.T) {
+	testAsyncOverflow(t, "drop_oldest", []string{"w0", "w3", "w4"})
+}
+
+func TestAsyncDropNewest(t *testing.T) {
+	testAsyncOverflow(t, "drop_newest", []string{"w0", "w1", "w2"})
+}
+
+// Test that Event fields follow the message.
+func TestEvent(t *testing.T) {
+	setFlags()
+	defer logging.swap(logging.newBuffers())
+	WarningEvent().Str("k", "v").Str("q", "a b").Int("n", -1).Uint64("u", 2).Float64("f", 0.5).Bool("b", true).Err(nil).Msg("event")
+	V(100).InfoEvent().Str("k", "v").Msg("not logged")
+	want := "] event k=v q=\"a b\" n=-1 u=2 f=0.5 b=true err=nil\n"
+	if !strings.HasSuffix(contents(infoLog), want) {
+		t.Errorf("got %q, want suffix %q", contents(infoLog), want)
+	}
+	if !contains(warningLog, want, t) {
+		t.Errorf("Warning failed: %q", contents(warningLog))
+	}
+	InfoEvent().Str("k", "v").Msgf("line %d\n", 2)
+	if want := "] line 2 k=v\n"; !strings.HasSuffix(contents(infoLog), want) {
+		t.Errorf("got %q, want suffix %q", contents(infoLog), want)
+	}
+}
+
+// Test that Event does not allocate once its buffers are warmed up.
+func TestEventAllocs(t *testing.T) {
+	setFlags()
+	defer logging.swap(logging.swap(discardFiles()))
+	allocs := testing.AllocsPerRun(100, func() {
+		InfoEvent().Str("k", "v").Int("n", 42).Bool("ok", true).Msg("event")
+	})
+	if allocs != 0 {
+		t.Errorf("got %v allocations per Event, want 0", allocs)
+	}
+}
+
+// Test that Shutdown closes the log files and that logging then falls back
+// to standard error.
+func TestShutdown(t *testing.T) {
+	setFlags()
+	defer logging.swap(logging.newBuffers())
+	defer func(previous *os.File) { os.Stderr = previous }(os.Stderr)
+	f, err := ioutil.TempFile("", "lgstderr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	os.Stderr = f
+	defer func() {
+		logging.mu.Lock()
+		defer logging.mu.Unlock()
+		atomic.StoreUint32(&logging.closed, 0)
+		logging.shutdownOnce = sync.Once{}
+		logging.stopDaemon = make(chan struct{})
+		go logging.flushDaemon(logging.stopDaemon)
+	}()
+
+	Info("before")
+	info := logging.file[infoLog].(*flushBuffer)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := Shutdown(ctx); err != nil {
+		t.Fatal("Shutdown: ", err)
+	}
+	if logging.file[infoLog] != nil {
+		t.Error("Shutdown left the INFO log open")
+	}
+	Info("after")
+	if !strings.Contains(info.String(), "] before") || strings.Contains(info.String(), "after") {
+		t.Errorf("INFO log has wrong contents: %q", info.String())
+	}
+	data, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "] after") || strings.Contains(string(data), "before") {
+		t.Errorf("standard error has wrong contents: %q", data)
+	}
+	if err := Shutdown(ctx); err != nil {
+		t.Error("second Shutdown: ", err)
+	}
+}
+
+// countBuffer is a flushBuffer which counts calls to Flush and Sync.
+type countBuffer struct {
+	flushBuffer
+	flushes, syncs int
+}
+
+func (c *countBuffer) Flush() error {
+	c.flushes++
+	return nil
+}
+
+func (c *countBuffer) Sync() error {
+	c.syncs++
+	return nil
+}
+
+func TestFlushPolicy(t *testing.T) {
+	setFlags()
+	var bufs [numSeverity]*countBuffer
+	var writers [numSeverity]flushSyncWriter
+	for i := range bufs {
+		bufs[i] = new(countBuffer)
+		writers[i] = bufs[i]
+	}
+	defer logging.swap(logging.swap(writers))
+	defer logging.flushSeverity.set(logging.flushSeverity.get())
+	defer func(previous fsyncPolicy) { atomic.StoreInt64((*int64)(&logging.fsync), int64(previous)) }(logging.fsync.get())
+	if err := SetFlushSeverity("WARNING"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetFsync("error"); err != nil {
+		t.Fatal(err)
+	}
+	check := func(name string, s severity, flushes, syncs int) {
+		t.Helper()
+		if b := bufs[s]; b.flushes != flushes || b.syncs != syncs {
+			t.Errorf("after %s, %s log flushed %d and synced %d times; expected %d and %d", name, severityName[s], b.flushes, b.syncs, flushes, syncs)
+		}
+	}
+	Info("info")
+	check("Info", infoLog, 0, 0)
+	Warning("warning")
+	check("Warning", infoLog, 1, 0)
+	check("Warning", warningLog, 1, 0)
+	check("Warning", errorLog, 0, 0)
+	Error("error")
+	check("Error", infoLog, 2, 1)
+	check("Error", errorLog, 1, 1)
+	if err := SetFsync("never"); err != nil {
+		t.Fatal(err)
+	}
+	logging.lockAndFlushAll()
+	check("flushAll", infoLog, 3, 1)
+	if err := SetFsync("1x"); err == nil {
+		t.Error("SetFsync accepted 1x")
+	}
+	if err := SetFlushInterval(0); err == nil {
+		t.Error("SetFlushInterval accepted 0")
+	}
+	if d := logging.flushInterval.get(); d <= 0 {
+		t.Errorf("flush interval set to %v", d)
+	}
+}
+
+func TestFsyncBytes(t *testing.T) {
+	setFlags()
+	dir, err := ioutil.TempDir("", "lgfsync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	onceLogDirs.Do(createLogDirs)
+	defer func(previous []string) { logDirs = previous }(logDirs)
+	logDirs = []string{dir}
+	defer func(previous fsyncPolicy) { atomic.StoreInt64((*int64)(&logging.fsync), int64(previous)) }(logging.fsync.get())
+	if err := SetFsync("100"); err != nil {
+		t.Fatal(err)
+	}
+	sb := &syncBuffer{logger: &logging, sev: infoLog}
+	if err := sb.rotateFile(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	defer sb.Close()
+	line := []byte(strings.Repeat("x", 39) + "\n")
+	sb.Write(line)
+	sb.Write(line)
+	if sb.unsynced != 80 || sb.Buffered() != 80 {
+		t.Errorf("after 80 bytes: %d unsynced and %d buffered", sb.unsynced, sb.Buffered())
+	}
+	sb.Write(line)
+	if sb.unsynced != 0 || sb.Buffered() != 0 {
+		t.Errorf("after 120 bytes: %d unsynced and %d buffered", sb.unsynced, sb.Buffered())
+	}
+}
+
+// withLogDir creates the log files in a new temporary directory, redirects
+// standard error to a temporary file and installs files as the log files. It
+// returns the directory, the standard error file and a function which
+// restores everything, closing the log files created meanwhile.
+func withLogDir(t *testing.T, files [numSeverity]flushSyncWriter) (string, *os.File, func()) {
+	dir, err := ioutil.TempDir("", "lglogdir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr, err := ioutil.TempFile("", "lgstderr")
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	onceLogDirs.Do(createLogDirs)
+	oldDirs, oldStderr := logDirs, os.Stderr
+	logDirs, os.Stderr = []string{dir}, stderr
+	old := logging.swap(files)
+	return dir, stderr, func() {
+		for _, f := range logging.swap(old) {
+			if sb, ok := f.(*syncBuffer); ok {
+				sb.Close()
+			}
+		}
+		logging.fileErr = fileErrorState{}
+		logDirs, os.Stderr = oldDirs, oldStderr
+		stderr.Close()
+		os.Remove(stderr.Name())
+		os.RemoveAll(dir)
+	}
+}
+
+func TestReopen(t *testing.T) {
+	setFlags()
+	dir, _, restore := withLogDir(t, [numSeverity]flushSyncWriter{})
+	defer restore()
+	defer func(previous bool) { *stableNames = previous }(*stableNames)
+	*stableNames = true
+
+	name := filepath.Join(dir, program+".INFO")
+	Info("before")
+	Flush()
+	if err := os.Rename(name, name+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := Reopen(); err != nil {
+		t.Fatal("Reopen: ", err)
+	}
+	Info("after")
+	Flush()
+	rotated, err := ioutil.ReadFile(name + ".1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(rotated), "] before") || strings.Contains(string(rotated), "after") {
+		t.Errorf("rotated file has wrong contents: %q", rotated)
+	}
+	current, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(current), "] after") || strings.Contains(string(current), "before") {
+		t.Errorf("reopened file has wrong contents: %q", current)
+	}
+}
+
+func TestReopenSameSecond(t *testing.T) {
+	setFlags()
+	_, _, restore := withLogDir(t, [numSeverity]flushSyncWriter{})
+	defer restore()
+	now := time.Now()
+	defer func(previous func() time.Time) { timeNow = previous }(timeNow)
+	timeNow = func() time.Time { return now }
+
+	Info("before")
+	sb, ok := logging.file[infoLog].(*syncBuffer)
+	if !ok {
+		t.Fatal("log files were not created")
+	}
+	file := sb.file
+	if err := Reopen(); err != nil {
+		t.Fatal("Reopen: ", err)
+	}
+	if sb.file != file {
+		t.Error("the log file was replaced by one with the same name")
+	}
+	Info("after")
+	Flush()
+	data, err := ioutil.ReadFile(file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "] before") || !strings.Contains(string(data), "] after") {
+		t.Errorf("log file has wrong contents: %q", data)
+	}
+}
+
+func TestReopenFails(t *testing.T) {
+	setFlags()
+	dir, _, restore := withLogDir(t, [numSeverity]flushSyncWriter{})
+	defer restore()
+	defer func(previous errorPolicy) { atomic.StoreInt32((*int32)(&logging.errorPolicy), int32(previous)) }(logging.errorPolicy.get())
+	logging.errorPolicy.Set("retry")
+	fileErrors := atomic.LoadInt64(&Stats.FileErrors)
+
+	Info("before")
+	sb, ok := logging.file[infoLog].(*syncBuffer)
+	if !ok {
+		t.Fatal("log files were not created")
+	}
+	// Replace the log directory by a file so that new files cannot be
+	// created in it.
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(dir, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := Reopen(); err == nil {
+		t.Fatal("Reopen succeeded without a log directory")
+	}
+	if sb.file == nil {
+		t.Fatal("the old log file was not kept")
+	}
+	Info("after")
+	if n := atomic.LoadInt64(&Stats.FileErrors); n != fileErrors {
+		t.Errorf("writing to the old log file failed %d times", n-fileErrors)
+	}
+
+	// Reopening on a signal applies -log_error_policy.
+	logging.reopenOrFail()
+	if n := atomic.LoadInt64(&Stats.FileErrors); n != fileErrors+1 {
+		t.Errorf("expected one file error, got %d", n-fileErrors)
+	}
+	if logging.file[infoLog] != nil || !logging.fileErr.failed {
+		t.Error("the log files were not given up on")
+	}
+}
+
+// failBuffer is a flushSyncWriter whose writes fail.
+type failBuffer struct {
+	flushBuffer
+	closed bool
+}
+
+func (f *failBuffer) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+func (f *failBuffer) Close() error {
+	f.closed = true
+	return nil
+}
+
+func TestFileErrorPolicy(t *testing.T) {
+	setFlags()
+	fail := new(failBuffer)
+	var files [numSeverity]flushSyncWriter
+	for s := range files {
+		files[s] = fail
+	}
+	_, f, restore := withLogDir(t, files)
+	defer restore()
+	now := time.Now()
+	defer func(previous func() time.Time) { timeNow = previous }(timeNow)
+	timeNow = func() time.Time { return now }
+	defer func(previous errorPolicy) { atomic.StoreInt32((*int32)(&logging.errorPolicy), int32(previous)) }(logging.errorPolicy.get())
+	var errs []error
+	OnFileError(func(err error) { errs = append(errs, err) })
+	defer OnFileError(nil)
+	fileErrors := atomic.LoadInt64(&Stats.FileErrors)
+	dropped := Stats.Info.Dropped()
+
+	if err := logging.errorPolicy.Set("retry"); err != nil {
+		t.Fatal(err)
+	}
+	Info("first")
+	Info("second")
+	if len(errs) != 1 || atomic.LoadInt64(&Stats.FileErrors) != fileErrors+1 {
+		t.Errorf("expected one file error, got %v", errs)
+	}
+	if !fail.closed || logging.file[infoLog] != nil {
+		t.Error("failed files were not closed")
+	}
+	logging.errorPolicy.Set("drop")
+	Info("third")
+	if n := Stats.Info.Dropped(); n != dropped+1 {
+		t.Errorf("expected %d dropped lines, got %d", dropped+1, n)
+	}
+	now = now.Add(minFileRetry)
+	Info("fourth")
+	if logging.fileErr.backoff != minFileRetry {
+		t.Errorf("backoff reset to %v before the log files were flushed", logging.fileErr.backoff)
+	}
+	Flush()
+	if logging.fileErr.backoff != 0 {
+		t.Errorf("backoff not reset after flushing: %v", logging.fileErr.backoff)
+	}
+	data, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr := string(data)
+	if !strings.Contains(stderr, "] first") || !strings.Contains(stderr, "] second") || strings.Contains(stderr, "third") || strings.Contains(stderr, "fourth") {
+		t.Errorf("standard error has wrong contents: %q", stderr)
+	}
+	sb, ok := logging.file[infoLog].(*syncBuffer)
+	if !ok {
+		t.Fatal("log files were not recreated")
+	}
+	data, err = ioutil.ReadFile(sb.file.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "] fourth") {
+		t.Errorf("recreated log file has wrong contents: %q", data)
+	}
+}
+
+func TestExpandLogDir(t *testing.T) {
+	defer os.Setenv("XDG_STATE_HOME", os.Getenv("XDG_STATE_HOME"))
+	defer os.Setenv("LG_TEST_UNSET", os.Getenv("LG_TEST_UNSET"))
+	os.Setenv("XDG_STATE_HOME", "/state")
+	os.Setenv("LG_TEST_UNSET", "")
+	for dir, expect := range map[string]string{
+		"/var/log":                   "/var/log",
+		"$XDG_STATE_HOME/${PROGRAM}": "/state/" + program,
+		"$TMPDIR/x":                  os.TempDir() + "/x",
+		"$LG_TEST_UNSET/x":           "",
+	} {
+		if got := expandLogDir(dir); got != expect {
+			t.Errorf("expandLogDir(%q): expected %q, got %q", dir, expect, got)
+		}
+	}
+}
+
+func TestCreateLogDirFallback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lgdirs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	onceLogDirs.Do(createLogDirs)
+	defer func(previous []string) { logDirs = previous }(logDirs)
+	defer func(previous fileMode) { logDirMode = previous }(logDirMode)
+	defer func(previous fileMode) { logFileMode = previous }(logFileMode)
+	// By default, log files and created directories are not readable by
+	// other users.
+	logDirs = []string{filepath.Join(dir, "default")}
+	f, fname, err := create("INFO", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if fi, err := os.Stat(fname); err != nil || fi.Mode().Perm()&^0640 != 0 {
+		t.Errorf("log file has mode %v, expected at most 0640 (%v)", fi.Mode(), err)
+	}
+	if fi, err := os.Stat(logDirs[0]); err != nil || fi.Mode().Perm()&^0750 != 0 {
+		t.Errorf("log directory has mode %v, expected at most 0750 (%v)", fi.Mode(), err)
+	}
+
+	if err := logDirMode.Set("0"); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "missing", "logs")
+	logDirs = []string{missing, filepath.Join(dir, "file")}
+	if err := ioutil.WriteFile(logDirs[1], nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := create("INFO", time.Now()); err == nil || !strings.Contains(err.Error(), missing) || !strings.Contains(err.Error(), logDirs[1]) {
+		t.Errorf("expected an error mentioning both directories, got %v", err)
+	}
+
+	if err := logDirMode.Set("0750"); err != nil {
+		t.Fatal(err)
+	}
+	if err := logFileMode.Set("0600"); err != nil {
+		t.Fatal(err)
+	}
+	f, fname, err = create("INFO", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if filepath.Dir(fname) != missing {
+		t.Errorf("log file created in %s, expected %s", filepath.Dir(fname), missing)
+	}
+	if fi, err := os.Stat(fname); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("log file has mode %v, expected 0600 (%v)", fi.Mode(), err)
+	}
+	if fi, err := os.Stat(missing); err != nil || fi.Mode().Perm()&^0750 != 0 {
+		t.Errorf("log directory has mode %v, expected at most 0750 (%v)", fi.Mode(), err)
+	}
+	if err := logFileMode.Set("0800"); err == nil {
+		t.Error("expected an error setting mode 0800")
+	}
+}
+
+func TestLogNameTemplate(t *testing.T) {
+	defer func(previous nameTemplate) { fileTemplate = previous }(fileTemplate)
+	defer func(previous nameTemplate) { linkTemplate = previous }(linkTemplate)
+	defer func(previous string) { *programOverride = previous }(*programOverride)
+	*programOverride = "app"
+	if err := fileTemplate.Set("{program}.{tag}.{seq}.log"); err != nil {
+		t.Fatal(err)
+	}
+	if err := linkTemplate.Set("{program}-{tag}.log"); err != nil {
+		t.Fatal(err)
+	}
+	if err := fileTemplate.Set("{program}.log"); err == nil {
+		t.Error("accepted a template without {tag}")
+	}
+	if err := fileTemplate.Set("{program}.{tag}.{pid}.log"); err == nil {
+		t.Error("accepted a file template without {time} or {seq}")
+	}
+	if err := fileTemplate.Set("{program}-{tag}.log"); err == nil {
+		t.Error("accepted a file template equal to the link template")
+	}
+	if err := linkTemplate.Set("{program}.{tag}.{seq}.log"); err == nil {
+		t.Error("accepted a link template equal to the file template")
+	}
+	logging.mu.Lock()
+	defer logging.mu.Unlock()
+	delete(fileSeq, "TEST")
+	first, link := logName("TEST", time.Now())
+	second, _ := logName("TEST", time.Now())
+	if first != "app.TEST.0.log" || second != "app.TEST.1.log" || link != "app-TEST.log" {
+		t.Errorf("unexpected names %s, %s and %s", first, second, link)
+	}
+}
+
+// TestLogNameSeqRestart checks that a process restarting the {seq} count does
+// not overwrite the log files of earlier processes.
+func TestLogNameSeqRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lgseq")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	onceLogDirs.Do(createLogDirs)
+	defer func(previous []string) { logDirs = previous }(logDirs)
+	logDirs = []string{dir}
+	defer func(previous nameTemplate) { fileTemplate = previous }(fileTemplate)
+	if err := fileTemplate.Set("{program}.{tag}.{seq}.log"); err != nil {
+		t.Fatal(err)
+	}
+	logging.mu.Lock()
+	defer logging.mu.Unlock()
+
+	delete(fileSeq, "TEST")
+	f, first, err := create("TEST", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString("first run\n")
+	f.Close()
+	delete(fileSeq, "TEST")
+	f, second, err := create("TEST", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if first == second {
+		t.Errorf("both runs created %s", first)
+	}
+	data, err := ioutil.ReadFile(first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "first run\n" {
+		t.Errorf("first log file has wrong contents: %q", data)
+	}
+}
+
+func TestSeverityFiles(t *testing.T) {
+	setFlags()
+	defer logging.swap(logging.newBuffers())
+	defer func(previous severityFiles) { atomic.StoreUint32((*uint32)(&logging.files), uint32(previous)) }(logging.files.get())
+	if err := logging.files.Set("INFO,ERROR"); err != nil {
+		t.Fatal(err)
+	}
+	Error("err")
+	Warning("warn")
+	if !contains(infoLog, "] err", t) || !contains(infoLog, "] warn", t) {
+		t.Errorf("INFO log has wrong contents: %q", contents(infoLog))
+	}
+	if contents(warningLog) != "" {
+		t.Errorf("WARNING log written: %q", contents(warningLog))
+	}
+	if !contains(errorLog, "] err", t) || contains(errorLog, "warn", t) {
+		t.Errorf("ERROR log has wrong contents: %q", contents(errorLog))
+	}
+	if got := logging.files.String(); got != "INFO,ERROR" {
+		t.Errorf("String: expected INFO,ERROR, got %s", got)
+	}
+	if err := logging.files.Set("INFO,DEBUGGING"); err == nil {
+		t.Error("accepted an unknown severity")
+	}
+
+	defer func(previous bool) { logging.fanout = previous }(logging.fanout)
+	logging.fanout = false
+	Error("alone")
+	if contains(infoLog, "alone", t) || !contains(errorLog, "] alone", t) {
+		t.Errorf("without fanout, the line was not written to the ERROR log only")
+	}
+}
+
+func TestSeverities(t *testing.T) {
+	setFlags()
+	defer logging.swap(logging.newBuffers())
+	defer func(previous severity) { logging.minSeverity.set(previous) }(logging.minSeverity.get())
+	Debug("discarded")
+	DebugEvent().Msg("discarded")
+	if contains(infoLog, "discarded", t) {
+		t.Errorf("DEBUG line logged by default: %q", contents(infoLog))
+	}
+	if err := SetMinSeverity("DEBUG"); err != nil {
+		t.Fatal(err)
+	}
+	Debug("debug")
+	Notice("notice")
+	Critical("critical")
+	if !contains(infoLog, "] debug", t) || !strings.HasPrefix(contents(infoLog), "D") {
+		t.Errorf("DEBUG line not in the INFO log: %q", contents(infoLog))
+	}
+	if contents(debugLog) != "" || contents(noticeLog) != "" || contents(criticalLog) != "" {
+		t.Error("DEBUG, NOTICE or CRITICAL log written without -log_files")
+	}
+	if !contains(infoLog, "] notice", t) || contains(warningLog, "notice", t) {
+		t.Errorf("NOTICE line in the wrong logs")
+	}
+	for _, s := range []severity{infoLog, warningLog, errorLog} {
+		if !contains(s, "] critical", t) {
+			t.Errorf("CRITICAL line not in the %s log", severityName[s])
+		}
+	}
+	if contains(fatalLog, "critical", t) {
+		t.Error("CRITICAL line in the FATAL log")
+	}
+	if n := Stats.Critical.Lines(); n == 0 {
+		t.Error("CRITICAL line not counted")
+	}
+	if err := SetMinSeverity("WARNING"); err != nil {
+		t.Fatal(err)
+	}
+	Notice("below the minimum")
+	Warning("at the minimum")
+	if contains(infoLog, "below the minimum", t) || !contains(infoLog, "] at the minimum", t) {
+		t.Errorf("-minloglevel=WARNING not applied: %q", contents(infoLog))
+	}
+}
+
+func TestSeverityFlag(t *testing.T) {
+	var s severity
+	for value, expect := range map[string]severity{
+		"0":        infoLog,
+		"2":        errorLog,
+		"3":        fatalLog,
+		"notice":   noticeLog,
+		"CRITICAL": criticalLog,
+	} {
+		if err := s.Set(value); err != nil || s != expect {
+			t.Errorf("Set(%q): expected %s, got %s (%v)", value, severityName[expect], s.String(), err)
+		}
+	}
+	if err := s.Set("4"); err == nil {
+		t.Error("Set(4) succeeded")
+	}
+}
+
+func TestContextFields(t *testing.T) {
+	setFlags()
+	defer logging.swap(logging.newBuffers())
+	ctx := NewContext(context.Background(), KV("request_id", "r1"))
+	ctx = NewContext(ctx, KV("user", "j doe"))
+	InfoCtx(ctx, "served")
+	FromContext(ctx).Warningf("slow %dms", 5)
+	InfoCtx(context.Background(), "plain")
+	InfoEvent().Int("n", 1).Ctx(ctx).Msg("event")
+	NoticeCtx(ctx, "noticed")
+	FromContext(ctx).Criticalf("down %d", 2)
+	DebugCtx(ctx, "discarded")
+	for _, expect := range []string{
+		`] served request_id=r1 user="j doe"` + "\n",
+		`] slow 5ms request_id=r1 user="j doe"` + "\n",
+		"] plain\n",
+		`] event n=1 request_id=r1 user="j doe"` + "\n",
+		`] noticed request_id=r1 user="j doe"` + "\n",
+		`] down 2 request_id=r1 user="j doe"` + "\n",
+	} {
+		if !contains(infoLog, expect, t) {
+			t.Errorf("INFO log lacks %q: %q", expect, contents(infoLog))
+		}
+	}
+	if !contains(warningLog, "] slow 5ms request_id=r1", t) {
+		t.Errorf("WARNING log has wrong contents: %q", contents(warningLog))
+	}
+	if !contains(errorLog, "] down 2 request_id=r1", t) || contains(infoLog, "discarded", t) {
+		t.Errorf("CRITICAL or DEBUG line in the wrong logs: %q", contents(errorLog))
+	}
+	if fields := ContextFields(ctx); len(fields) != 2 || fields[0].Key != "request_id" || fields[1].Value != "j doe" {
+		t.Errorf("unexpected context fields %v", fields)
+	}
+}
+
+func TestContextHook(t *testing.T) {
+	setFlags()
+	defer logging.swap(logging.newBuffers())
+	defer func(previous []ContextHook) { contextHooks.hooks = previous }(contextHooks.hooks)
+	type traceKey struct{}
+	var seen []string
+	AddContextHook(func(ctx context.Context, severity, msg string) []Field {
+		seen = append(seen, severity+":"+msg)
+		if id, ok := ctx.Value(traceKey{}).(string); ok {
+			return []Field{KV("trace_id", id)}
+		}
+		return nil
+	})
+	ctx := NewContext(context.WithValue(context.Background(), traceKey{}, "t1"), KV("user", "u"))
+	ErrorCtx(ctx, "failed\n")
+	InfoCtx(context.Background(), "plain")
+	InfoEvent().Ctx(ctx).Int("n", 1).Msg("event")
+	Info("no context")
+	for _, expect := range []string{
+		"] failed user=u trace_id=t1\n",
+		"] plain\n",
+		"] event user=u n=1 trace_id=t1\n",
+	} {
+		if !contains(infoLog, expect, t) {
+			t.Errorf("INFO log lacks %q: %q", expect, contents(infoLog))
+		}
+	}
+	if got, want := strings.Join(seen, ","), "ERROR:failed,INFO:plain,INFO:event"; got != want {
+		t.Errorf("hook called with %q, want %q", got, want)
+	}
+}
+
+// memSink is a Sink keeping the records it receives.
+type memSink struct {
+	mu      sync.Mutex
+	records []*Record
+	flushes int
+	closed  bool
+}
+
+func (m *memSink) Emit(r *Record) error {
+	m.mu.Lock()
+	m.records = append(m.records, r)
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *memSink) Flush() error {
+	m.mu.Lock()
+	m.flushes++
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *memSink) Close() error {
+	m.closed = true
+	return nil
+}
+
+func TestSinks(t *testing.T) {
+	setFlags()
+	defer logging.swap(logging.newBuffers())
+	all, warnings := &memSink{}, &memSink{}
+	if err := AddSink(all, "DEBUG"); err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveSink(all)
+	if err := AddSink(warnings, "warning"); err != nil {
+		t.Fatal(err)
+	}
+	defer RemoveSink(warnings)
+	if err := AddSink(&memSink{}, "LOUD"); err == nil {
+		t.Error("AddSink accepted an unknown severity")
+	}
+	ctx := NewContext(context.Background(), KV("request_id", "r1"))
+	Info("plain\n")
+	WarningfCtx(ctx, "slow %dms", 5)
+	ErrorEvent().Str("k", "v v").Int("n", 1).Ctx(ctx).Msg("event")
+	Flush()
+	if len(all.records) != 3 || len(warnings.records) != 2 {
+		t.Fatalf("sinks got %d and %d records, want 3 and 2", len(all.records), len(warnings.records))
+	}
+	if all.flushes != 1 {
+		t.Errorf("sink flushed %d times, want 1", all.flushes)
+	}
+	r := all.records[0]
+	if r.Severity != "INFO" || r.Message != "plain" || r.File != "glog_test.go" || r.Line == 0 || len(r.Fields) != 0 {
+		t.Errorf("unexpected record %+v", r)
+	}
+	if !strings.HasSuffix(r.Func, ".TestSinks") {
+		t.Errorf("Func is %q, want the test function", r.Func)
+	}
+	if !contains(infoLog, string(r.Text), t) || r.Time.IsZero() {
+		t.Errorf("record text %q not in INFO log %q", r.Text, contents(infoLog))
+	}
+	r = warnings.records[0]
+	if r.Severity != "WARNING" || r.Message != "slow 5ms" || len(r.Fields) != 1 || r.Fields[0] != KV("request_id", "r1") {
+		t.Errorf("unexpected context record %+v", r)
+	}
+	r = warnings.records[1]
+	if r.Severity != "ERROR" || r.Message != "event" || fmt.Sprint(r.Fields) != "[{k v v} {n 1} {request_id r1}]" {
+		t.Errorf("unexpected event record %+v", r)
+	}
+	if !strings.HasSuffix(string(r.Text), `] event k="v v" n=1 request_id=r1`+"\n") {
+		t.Errorf("unexpected event text %q", r.Text)
+	}
+	if !RemoveSink(warnings) || RemoveSink(warnings) {
+		t.Error("RemoveSink did not remove the sink exactly once")
+	}
+	Warning("after")
+	if len(warnings.records) != 2 || len(all.records) != 4 {
+		t.Error("removed sink still receives records")
+	}
+}
+
 func TestRollover(t *testing.T) {
 	setFlags()
 	var err error
@@ -371,6 +1661,41 @@ func TestRollover(t *testing.T) {
 	}
 }
 
+// Test that a file which is kept when it cannot be rotated within a second is
+// not rotated again on every write.
+func TestRolloverSameSecond(t *testing.T) {
+	setFlags()
+	_, _, restore := withLogDir(t, [numSeverity]flushSyncWriter{})
+	defer restore()
+	now := time.Now()
+	defer func(previous func() time.Time) { timeNow = previous }(timeNow)
+	timeNow = func() time.Time { return now }
+	defer func(previous uint64) { MaxSize = previous }(MaxSize)
+	MaxSize = 512
+
+	Info("x")
+	sb, ok := logging.file[infoLog].(*syncBuffer)
+	if !ok {
+		t.Fatal("log files were not created")
+	}
+	file := sb.file
+	seq := fileSeq["INFO"]
+	for i := 0; i < 5; i++ {
+		Info(strings.Repeat("x", int(MaxSize)))
+	}
+	if sb.file != file {
+		t.Error("the log file was replaced within a second")
+	}
+	if n := fileSeq["INFO"] - seq; n != 1 {
+		t.Errorf("tried rotating %d times within a second, want once", n)
+	}
+	now = now.Add(time.Second)
+	Info("y")
+	if sb.file == file {
+		t.Error("the log file was not rotated in the next second")
+	}
+}
+
 func TestLogBacktraceAt(t *testing.T) {
 	setFlags()
 	defer logging.swap(logging.newBuffers())
@@ -407,9 +1732,149 @@ func TestLogBacktraceAt(t *testing.T) {
 	}
 }
 
+// traceHelper logs from a function named by TestLogBacktraceAtFunc.
+func traceHelper() {
+	Info("traced by function name")
+}
+
+func TestLogBacktraceAtFunc(t *testing.T) {
+	setFlags()
+	defer logging.swap(logging.newBuffers())
+	defer logging.traceLocation.Set("")
+	if err := logging.traceLocation.Set("nosuchfile.go:1,lg.traceHelper"); err != nil {
+		t.Fatal("error setting log_backtrace_at: ", err)
+	}
+	traceHelper()
+	if !contains(infoLog, "lg.traceHelper(", t) {
+		t.Fatal("got no trace back; log is ", contents(infoLog))
+	}
+	for _, v := range []string{"glog_test.go", "file.go:x", "a.go:1:2", "nodot"} {
+		if err := logging.traceLocation.Set(v); err == nil {
+			t.Errorf("log_backtrace_at accepted %q", v)
+		}
+	}
+}
+
+func TestLogBacktraceLimit(t *testing.T) {
+	setFlags()
+	defer logging.swap(logging.newBuffers())
+	defer logging.traceLocation.Set("")
+	defer func(previous int) { logging.traceLimit = previous }(logging.traceLimit)
+	logging.traceLimit = 2
+	if err := logging.traceLocation.Set("lg.traceHelper"); err != nil {
+		t.Fatal("error setting log_backtrace_at: ", err)
+	}
+	for i := 0; i < 5; i++ {
+		traceHelper()
+	}
+	if n := strings.Count(contents(infoLog), "lg.traceHelper("); n != 2 {
+		t.Errorf("got %d stack traces, want 2; log is %s", n, contents(infoLog))
+	}
+}
+
+func TestLogBacktraceInterval(t *testing.T) {
+	setFlags()
+	defer logging.swap(logging.newBuffers())
+	defer logging.traceLocation.Set("")
+	defer func(previous time.Duration) { logging.traceInterval = previous }(logging.traceInterval)
+	defer func(previous func() time.Time) { timeNow = previous }(timeNow)
+	now := time.Date(2006, 1, 2, 15, 4, 5, 0, time.Local)
+	timeNow = func() time.Time { return now }
+	logging.traceInterval = time.Minute
+	if err := logging.traceLocation.Set("lg.traceHelper"); err != nil {
+		t.Fatal("error setting log_backtrace_at: ", err)
+	}
+	traceHelper()
+	traceHelper()
+	now = now.Add(time.Minute)
+	traceHelper()
+	if n := strings.Count(contents(infoLog), "lg.traceHelper("); n != 2 {
+		t.Errorf("got %d stack traces, want 2; log is %s", n, contents(infoLog))
+	}
+}
+
 func BenchmarkHeader(b *testing.B) {
 	for i := 0; i < b.N; i++ {
-		buf, _, _ := logging.header(infoLog, 0)
+		buf, _, _, _ := logging.header(infoLog, 0)
 		logging.putBuffer(buf)
 	}
 }
+
+// discard is a flushSyncWriter that drops everything written to it.
+type discard struct{}
+
+func (discard) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (discard) Flush() error {
+	return nil
+}
+
+func (discard) Sync() error {
+	return nil
+}
+
+// discardFiles returns log files for every severity which drop everything.
+func discardFiles() [numSeverity]flushSyncWriter {
+	var files [numSeverity]flushSyncWriter
+	for s := range files {
+		files[s] = discard{}
+	}
+	return files
+}
+
+// The Parallel benchmarks show how logging scales with GOMAXPROCS, run them
+// with go test -run=NONE -bench=Parallel -cpu=1,2,4,8.
+
+func BenchmarkInfoParallel(b *testing.B) {
+	setFlags()
+	defer logging.swap(logging.swap(discardFiles()))
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			Info("benchmark")
+		}
+	})
+}
+
+func BenchmarkMemlogParallel(b *testing.B) {
+	setFlags()
+	defer logging.swap(logging.swap(discardFiles()))
+	defer func(previous bool) { logging.toMemory = previous }(logging.toMemory)
+	logging.toMemory = true
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			Info("benchmark")
+		}
+	})
+}
+
+func BenchmarkVmoduleParallel(b *testing.B) {
+	logging.vmodule.Set("glog_test=2")
+	defer logging.vmodule.Set("")
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if V(3) {
+				b.Fatal("V enabled for 3")
+			}
+		}
+	})
+}
+
+func BenchmarkInfof(b *testing.B) {
+	setFlags()
+	defer logging.swap(logging.swap(discardFiles()))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		Infof("request k=%s n=%d", "v", i)
+	}
+}
+
+func BenchmarkEvent(b *testing.B) {
+	setFlags()
+	defer logging.swap(logging.swap(discardFiles()))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		InfoEvent().Str("k", "v").Int("n", i).Msg("request")
+	}
+}
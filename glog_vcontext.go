@@ -0,0 +1,106 @@
+package lg
+
+import (
+	"context"
+	"runtime"
+	"sync"
+)
+
+// verbosityKey is the key of the contextVerbosity of a context.
+type verbosityKey struct{}
+
+// contextVerbosity is the verbosity override carried by a context.
+type contextVerbosity struct {
+	level  Level          // V level enabled for every file, in addition to -v
+	module *contextModule // vmodule override, or nil
+}
+
+// contextModule is a vmodule override together with its own cache of V levels
+// by PC, the counterpart of loggingT.vmap. It is shared by all contexts
+// derived from the one it was set on.
+type contextModule struct {
+	filter []modulePat
+	mu     sync.RWMutex
+	vmap   map[uintptr]Level
+}
+
+// WithVerbosity returns a copy of ctx with which VCtx reports V level level
+// as enabled everywhere, whatever the -v flag says. A vmodule override set on
+// ctx with WithVmodule is kept.
+//
+//	if r.Header.Get("X-Debug") != "" {
+//		ctx = lg.WithVerbosity(ctx, 3)
+//	}
+func WithVerbosity(ctx context.Context, level Level) context.Context {
+	cv := &contextVerbosity{level: level}
+	if parent := verbosityOf(ctx); parent != nil {
+		cv.module = parent.module
+	}
+	return context.WithValue(ctx, verbosityKey{}, cv)
+}
+
+// WithVmodule returns a copy of ctx with which VCtx reports the V levels of
+// spec, which has the syntax of the -vmodule flag, as enabled in addition to
+// those of the -v and -vmodule flags. A verbosity set on ctx with
+// WithVerbosity is kept.
+func WithVmodule(ctx context.Context, spec string) (context.Context, error) {
+	filter, err := parseVmodule(spec)
+	if err != nil {
+		return ctx, err
+	}
+	cv := &contextVerbosity{}
+	if parent := verbosityOf(ctx); parent != nil {
+		cv.level = parent.level
+	}
+	if len(filter) > 0 {
+		cv.module = &contextModule{filter: filter, vmap: make(map[uintptr]Level)}
+	}
+	return context.WithValue(ctx, verbosityKey{}, cv), nil
+}
+
+// verbosityOf returns the verbosity override of ctx, or nil.
+func verbosityOf(ctx context.Context) *contextVerbosity {
+	cv, _ := ctx.Value(verbosityKey{}).(*contextVerbosity)
+	return cv
+}
+
+// VCtx is like V, but also reports level as enabled if ctx carries a
+// verbosity or vmodule override enabling it for the caller, so that a single
+// request can be logged at a higher verbosity than the rest:
+//
+//	lg.VCtx(ctx, 2).Infof("cache miss for %q", key)
+func VCtx(ctx context.Context, level Level) Verbose {
+	if logging.v(1, level) {
+		return Verbose(true)
+	}
+	cv := verbosityOf(ctx)
+	if cv == nil {
+		return Verbose(false)
+	}
+	if cv.level >= level {
+		return Verbose(true)
+	}
+	if m := cv.module; m != nil {
+		var pcs [1]uintptr
+		if runtime.Callers(2, pcs[:]) == 0 {
+			return Verbose(false)
+		}
+		return Verbose(m.v(pcs[0]) >= level)
+	}
+	return Verbose(false)
+}
+
+// v returns the V level of the override for pc, computing and remembering it
+// the first time pc is seen.
+func (m *contextModule) v(pc uintptr) Level {
+	m.mu.RLock()
+	v, ok := m.vmap[pc]
+	m.mu.RUnlock()
+	if !ok {
+		v = matchV(m.filter, pc)
+		m.mu.Lock()
+		m.vmap[pc] = v
+		m.mu.Unlock()
+	}
+	return v
+}
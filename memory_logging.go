@@ -2,35 +2,37 @@ package lg
 
 import "sync"
 
-var (
-	memlogmu sync.RWMutex
-	memlog   []string
-)
+// memlog is a ring of the most recent lines logged to memory. It has its own
+// lock so that it is written without holding logging.mu.
+var memlog struct {
+	sync.RWMutex
+	lines []string
+	next  int // The index of the oldest line once lines is full
+}
+
+const memlogLength = 50000
 
 func logToMemory(line []byte) {
 	if len(line) < 1 {
 		return
 	}
-	const (
-		maxLength = 50000
-		cutN      = 1000
-	)
-
-	str := string(line)
-	str = str[0 : len(str)-1]
-	memlogmu.Lock()
-	memlog = append(memlog, str)
-	if len(memlog) > maxLength {
-		memlog = memlog[cutN:maxLength]
+	str := string(line[:len(line)-1])
+	memlog.Lock()
+	if len(memlog.lines) < memlogLength {
+		memlog.lines = append(memlog.lines, str)
+	} else {
+		memlog.lines[memlog.next] = str
+		memlog.next = (memlog.next + 1) % memlogLength
 	}
-	memlogmu.Unlock()
+	memlog.Unlock()
 }
 
 // Memlog returns the in memory log file
 func Memlog() []string {
-	memlogmu.RLock()
-	lines := make([]string, len(memlog))
-	copy(lines, memlog)
-	memlogmu.RUnlock()
+	memlog.RLock()
+	lines := make([]string, 0, len(memlog.lines))
+	lines = append(lines, memlog.lines[memlog.next:]...)
+	lines = append(lines, memlog.lines[:memlog.next]...)
+	memlog.RUnlock()
 	return lines
 }
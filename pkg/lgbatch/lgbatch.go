@@ -0,0 +1,486 @@
+// Package lgbatch batches lg records for sinks sending them over a network.
+// A Batcher is an lg.Sink which queues records, groups them into batches by
+// count, size and latency, and hands the batches to an Exporter, retrying
+// failed ones with backoff and writing those which cannot be exported to a
+// dead letter file:
+//
+//	b := lgbatch.New(lgbatch.ExporterFunc(func(records []*lg.Record) error {
+//		return client.Send(records)
+//	}), lgbatch.Config{MaxRecords: 100, MaxLatency: time.Second})
+//	lg.AddSink(b, "INFO")
+//
+// An Exporter only has to send one batch. It returns an error wrapped by
+// Permanent for batches which retrying cannot help, and one from RetryAfter
+// when the server says how long to wait.
+package lgbatch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/thomasf/lg"
+)
+
+// Exporter sends batches of records. Export is called concurrently if
+// Config.Concurrency is above one, and must not keep or modify the records.
+type Exporter interface {
+	Export(records []*lg.Record) error
+}
+
+// ExporterFunc adapts a function to the Exporter interface.
+type ExporterFunc func(records []*lg.Record) error
+
+// Export calls f(records).
+func (f ExporterFunc) Export(records []*lg.Record) error {
+	return f(records)
+}
+
+// permanentError marks an error which retrying does not help.
+type permanentError struct{ err error }
+
+func (e permanentError) Error() string { return e.err.Error() }
+func (e permanentError) Unwrap() error { return e.err }
+
+// Permanent wraps err so that the batch it failed is not retried.
+func Permanent(err error) error {
+	return permanentError{err}
+}
+
+// retryAfterError carries the delay before retrying requested by a server.
+type retryAfterError struct {
+	err   error
+	delay time.Duration
+}
+
+func (e retryAfterError) Error() string { return e.err.Error() }
+func (e retryAfterError) Unwrap() error { return e.err }
+
+// RetryAfter wraps err so that the batch it failed is retried after delay,
+// instead of the backoff.
+func RetryAfter(err error, delay time.Duration) error {
+	return retryAfterError{err, delay}
+}
+
+// Overflow selects what Emit does when the queue is full.
+type Overflow int
+
+const (
+	DropOldest Overflow = iota // drop the oldest queued record
+	DropNewest                 // drop the record being emitted
+	Block                      // wait for room in the queue
+)
+
+// Config configures a Batcher. The zero value uses the defaults.
+type Config struct {
+	MaxRecords  int           // The maximum number of records of a batch, 512 if zero
+	MaxBytes    int           // The maximum size of a batch, 1 MiB if zero, see Size
+	MaxLatency  time.Duration // How long a record may wait for its batch to fill, one second if zero
+	Concurrency int           // The number of batches exported at once, one if zero
+	QueueSize   int           // The maximum number of queued records, 8192 if zero
+	Overflow    Overflow      // What to do when the queue is full
+
+	RetryTime  time.Duration // How long a batch is retried before it is given up on, one minute if zero
+	MinBackoff time.Duration // The first delay before retrying, 100ms if zero
+	MaxBackoff time.Duration // The longest delay before retrying, 5s if zero
+
+	// DeadLetter is the file which the records of the batches given up on
+	// are appended to, one JSON object per line. They are only counted
+	// if empty.
+	DeadLetter string
+	// Size returns the size of a record for MaxBytes, the length of its
+	// Text if nil.
+	Size func(r *lg.Record) int
+}
+
+// Stats are the counters of a Batcher.
+type Stats struct {
+	Exported     int64 // Records exported
+	Dropped      int64 // Records dropped because the queue was full
+	Failed       int64 // Records of the batches given up on
+	DeadLettered int64 // Records written to the dead letter file
+	Retries      int64 // Attempts to export a batch again
+}
+
+// entry is a queued record.
+type entry struct {
+	r    *lg.Record
+	seq  uint64    // The number of records queued before
+	size int       // The size of r, as given by Config.Size
+	at   time.Time // When r was queued
+}
+
+// batch is a group of consecutive records.
+type batch struct {
+	records []*lg.Record
+	first   uint64 // The seq of the first record
+}
+
+// Batcher is an lg.Sink batching records for an Exporter.
+type Batcher struct {
+	exp   Exporter
+	cfg   Config
+	stats Stats // Handled atomically.
+
+	mu       sync.Mutex
+	cond     *sync.Cond // Signalled whenever the state below changes.
+	queue    []entry
+	nextSeq  uint64          // The seq of the next record queued
+	cutUntil uint64          // Records with a lower seq are sent without waiting for their batch to fill
+	inflight map[uint64]bool // The first seqs of the batches being exported, and whether they were tried once
+	closed   bool
+	failures int   // The number of failed first attempts and batches given up on
+	lastErr  error // The error of the last of those
+
+	batches chan batch
+	wg      sync.WaitGroup // The dispatcher and export goroutines
+}
+
+// New returns a Batcher for exp and starts its goroutines.
+func New(exp Exporter, cfg Config) *Batcher {
+	if cfg.MaxRecords <= 0 {
+		cfg.MaxRecords = 512
+	}
+	if cfg.MaxBytes <= 0 {
+		cfg.MaxBytes = 1 << 20
+	}
+	if cfg.MaxLatency <= 0 {
+		cfg.MaxLatency = time.Second
+	}
+	if cfg.Concurrency <= 0 {
+		cfg.Concurrency = 1
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = 8192
+	}
+	if cfg.RetryTime <= 0 {
+		cfg.RetryTime = time.Minute
+	}
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = 100 * time.Millisecond
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = 5 * time.Second
+	}
+	if cfg.Size == nil {
+		cfg.Size = func(r *lg.Record) int { return len(r.Text) }
+	}
+	b := &Batcher{
+		exp:      exp,
+		cfg:      cfg,
+		inflight: make(map[uint64]bool),
+		batches:  make(chan batch),
+	}
+	b.cond = sync.NewCond(&b.mu)
+	b.wg.Add(1 + cfg.Concurrency)
+	go b.dispatch()
+	for i := 0; i < cfg.Concurrency; i++ {
+		go b.export()
+	}
+	return b
+}
+
+// ErrClosed is returned by the methods of a Batcher after Close.
+var ErrClosed = errors.New("lgbatch: batcher closed")
+
+// Emit is part of the lg.Sink interface. It queues r, applying
+// Config.Overflow if the queue is full.
+func (b *Batcher) Emit(r *lg.Record) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for !b.closed && len(b.queue) >= b.cfg.QueueSize {
+		switch b.cfg.Overflow {
+		case DropNewest:
+			atomic.AddInt64(&b.stats.Dropped, 1)
+			return nil
+		case DropOldest:
+			b.queue[0] = entry{}
+			b.queue = b.queue[1:]
+			atomic.AddInt64(&b.stats.Dropped, 1)
+		default:
+			b.cond.Wait()
+		}
+	}
+	if b.closed {
+		return ErrClosed
+	}
+	b.queue = append(b.queue, entry{r, b.nextSeq, b.cfg.Size(r), time.Now()})
+	b.nextSeq++
+	b.cond.Broadcast()
+	return nil
+}
+
+// Flush is part of the lg.Sink interface. It sends the records queued so
+// far without waiting for their batches to fill and waits until each batch
+// has been tried once, so that it does not block for Config.RetryTime while
+// the server is unreachable. Failed batches keep being retried afterwards.
+// Flush returns the last error if any batch failed meanwhile.
+func (b *Batcher) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return ErrClosed
+	}
+	return b.flush(false)
+}
+
+// flush implements Flush, and waits until the records are exported or given
+// up on if retried is set.
+// b.mu is held.
+func (b *Batcher) flush(retried bool) error {
+	target, failures := b.nextSeq, b.failures
+	if b.cutUntil < target {
+		b.cutUntil = target
+	}
+	b.cond.Broadcast()
+	for b.pending(retried) < target {
+		b.cond.Wait()
+	}
+	if b.failures != failures {
+		return b.lastErr
+	}
+	return nil
+}
+
+// pending returns the seq of the first record not yet exported or given up
+// on, or not yet tried once unless retried is set.
+// b.mu is held.
+func (b *Batcher) pending(retried bool) uint64 {
+	low := b.nextSeq
+	if len(b.queue) > 0 {
+		low = b.queue[0].seq
+	}
+	for first, tried := range b.inflight {
+		if first < low && (retried || !tried) {
+			low = first
+		}
+	}
+	return low
+}
+
+// Close is part of the lg.Sink interface. It flushes b and stops its
+// goroutines.
+func (b *Batcher) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return ErrClosed
+	}
+	err := b.flush(true)
+	b.closed = true
+	b.cond.Broadcast()
+	b.mu.Unlock()
+	b.wg.Wait()
+	return err
+}
+
+// Stats returns the counters of b.
+func (b *Batcher) Stats() Stats {
+	return Stats{
+		Exported:     atomic.LoadInt64(&b.stats.Exported),
+		Dropped:      atomic.LoadInt64(&b.stats.Dropped),
+		Failed:       atomic.LoadInt64(&b.stats.Failed),
+		DeadLettered: atomic.LoadInt64(&b.stats.DeadLettered),
+		Retries:      atomic.LoadInt64(&b.stats.Retries),
+	}
+}
+
+// dispatch is the goroutine grouping the queued records into batches for the
+// export goroutines.
+func (b *Batcher) dispatch() {
+	defer b.wg.Done()
+	defer close(b.batches)
+	for {
+		b.mu.Lock()
+		for len(b.queue) == 0 && !b.closed {
+			b.cond.Wait()
+		}
+		if len(b.queue) == 0 {
+			b.mu.Unlock()
+			return
+		}
+		// Wait for the batch to fill, or for its first record to have
+		// waited long enough.
+		deadline := b.queue[0].at.Add(b.cfg.MaxLatency)
+		var timer *time.Timer
+		for !b.ready() && time.Now().Before(deadline) {
+			if timer == nil {
+				timer = time.AfterFunc(time.Until(deadline), func() {
+					b.mu.Lock()
+					b.cond.Broadcast()
+					b.mu.Unlock()
+				})
+			}
+			b.cond.Wait()
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		next := b.cut()
+		b.cond.Broadcast() // There is room in the queue.
+		b.mu.Unlock()
+		b.batches <- next
+	}
+}
+
+// ready reports whether the queued records fill a batch or must be sent
+// without waiting.
+// b.mu is held.
+func (b *Batcher) ready() bool {
+	if b.closed || b.queue[0].seq < b.cutUntil || len(b.queue) >= b.cfg.MaxRecords {
+		return true
+	}
+	size := 0
+	for _, e := range b.queue {
+		if size += e.size; size >= b.cfg.MaxBytes {
+			return true
+		}
+	}
+	return false
+}
+
+// cut removes the records of the next batch from the queue, at least one and
+// at most Config.MaxRecords and Config.MaxBytes.
+// b.mu is held.
+func (b *Batcher) cut() batch {
+	n, size := 0, 0
+	for n < len(b.queue) && n < b.cfg.MaxRecords {
+		if size += b.queue[n].size; size > b.cfg.MaxBytes && n > 0 {
+			break
+		}
+		n++
+	}
+	next := batch{records: make([]*lg.Record, n), first: b.queue[0].seq}
+	for i := range next.records {
+		next.records[i] = b.queue[i].r
+	}
+	b.queue = append(b.queue[:0], b.queue[n:]...)
+	b.inflight[next.first] = false
+	return next
+}
+
+// export is an export goroutine.
+func (b *Batcher) export() {
+	defer b.wg.Done()
+	for next := range b.batches {
+		err := b.send(next)
+		if err != nil {
+			atomic.AddInt64(&b.stats.Failed, int64(len(next.records)))
+			b.deadLetter(next.records, err)
+		} else {
+			atomic.AddInt64(&b.stats.Exported, int64(len(next.records)))
+		}
+		b.mu.Lock()
+		delete(b.inflight, next.first)
+		if err != nil {
+			b.failures++
+			b.lastErr = err
+		}
+		b.cond.Broadcast()
+		b.mu.Unlock()
+	}
+}
+
+// send exports next, retrying with jittered exponential backoff for up to
+// Config.RetryTime unless the error is permanent.
+func (b *Batcher) send(next batch) error {
+	deadline := time.Now().Add(b.cfg.RetryTime)
+	backoff := b.cfg.MinBackoff
+	for tried := false; ; tried = true {
+		err := b.exp.Export(next.records)
+		if err == nil {
+			return nil
+		}
+		var permanent permanentError
+		if errors.As(err, &permanent) {
+			return err
+		}
+		if !tried {
+			b.triedOnce(next.first, err)
+		}
+		var wait time.Duration
+		var after retryAfterError
+		if errors.As(err, &after) && after.delay > 0 {
+			wait = after.delay
+		} else {
+			// Half of the backoff plus up to as much again, so that many
+			// programs do not retry in step.
+			wait = backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+			if backoff *= 2; backoff > b.cfg.MaxBackoff {
+				backoff = b.cfg.MaxBackoff
+			}
+		}
+		if time.Now().Add(wait).After(deadline) {
+			return err
+		}
+		time.Sleep(wait)
+		atomic.AddInt64(&b.stats.Retries, 1)
+	}
+}
+
+// triedOnce records that the first attempt to export the batch starting at
+// seq first failed with err, which lets Flush return.
+func (b *Batcher) triedOnce(first uint64, err error) {
+	b.mu.Lock()
+	b.inflight[first] = true
+	b.failures++
+	b.lastErr = err
+	b.cond.Broadcast()
+	b.mu.Unlock()
+}
+
+// deadRecord is a record of the dead letter file.
+type deadRecord struct {
+	Time     time.Time         `json:"time"`
+	Severity string            `json:"severity"`
+	File     string            `json:"file"`
+	Line     int               `json:"line"`
+	Func     string            `json:"func,omitempty"`
+	Message  string            `json:"message"`
+	Fields   map[string]string `json:"fields,omitempty"`
+	Error    string            `json:"error"`
+}
+
+// deadLetterMu serializes the writes to dead letter files.
+var deadLetterMu sync.Mutex
+
+// deadLetter appends records, which could not be exported because of err,
+// to the dead letter file.
+func (b *Batcher) deadLetter(records []*lg.Record, err error) {
+	if b.cfg.DeadLetter == "" {
+		return
+	}
+	deadLetterMu.Lock()
+	defer deadLetterMu.Unlock()
+	f, ferr := os.OpenFile(b.cfg.DeadLetter, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if ferr != nil {
+		return
+	}
+	defer f.Close()
+	enc := json.NewEncoder(f)
+	for _, r := range records {
+		d := deadRecord{
+			Time:     r.Time,
+			Severity: r.Severity,
+			File:     r.File,
+			Line:     r.Line,
+			Func:     r.Func,
+			Message:  r.Message,
+			Error:    err.Error(),
+		}
+		if len(r.Fields) > 0 {
+			d.Fields = make(map[string]string, len(r.Fields))
+			for _, f := range r.Fields {
+				d.Fields[f.Key] = fmt.Sprint(f.Value)
+			}
+		}
+		if enc.Encode(d) == nil {
+			atomic.AddInt64(&b.stats.DeadLettered, 1)
+		}
+	}
+}
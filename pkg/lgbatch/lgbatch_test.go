@@ -0,0 +1,261 @@
+package lgbatch
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/thomasf/lg"
+)
+
+// recorder is an Exporter keeping the batches it is given, after failing a
+// number of times.
+type recorder struct {
+	mu      sync.Mutex
+	batches [][]string
+	fail    int
+	err     error
+}
+
+func (rec *recorder) Export(records []*lg.Record) error {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if rec.fail > 0 {
+		rec.fail--
+		return rec.err
+	}
+	var msgs []string
+	for _, r := range records {
+		msgs = append(msgs, r.Message)
+	}
+	rec.batches = append(rec.batches, msgs)
+	return nil
+}
+
+func (rec *recorder) count() int {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return len(rec.batches)
+}
+
+func record(msg string) *lg.Record {
+	return &lg.Record{Time: time.Now(), Severity: "INFO", Message: msg, Text: []byte(msg + "\n")}
+}
+
+func TestMaxRecords(t *testing.T) {
+	rec := &recorder{}
+	b := New(rec, Config{MaxRecords: 2, MaxLatency: time.Hour})
+	defer b.Close()
+	for _, msg := range []string{"a", "b", "c", "d", "e"} {
+		b.Emit(record(msg))
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for rec.count() < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if err := b.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	if len(rec.batches) != 3 || len(rec.batches[0]) != 2 || len(rec.batches[2]) != 1 || rec.batches[2][0] != "e" {
+		t.Errorf("unexpected batches %q", rec.batches)
+	}
+}
+
+func TestMaxBytes(t *testing.T) {
+	rec := &recorder{}
+	// Each record is 4 bytes, so that three do not fit in 10.
+	b := New(rec, Config{MaxBytes: 10, MaxLatency: time.Hour})
+	for _, msg := range []string{"aaa", "bbb", "ccc"} {
+		b.Emit(record(msg))
+	}
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.batches) != 2 || len(rec.batches[0]) != 2 || len(rec.batches[1]) != 1 {
+		t.Errorf("unexpected batches %q", rec.batches)
+	}
+}
+
+func TestMaxLatency(t *testing.T) {
+	rec := &recorder{}
+	b := New(rec, Config{MaxLatency: 10 * time.Millisecond})
+	defer b.Close()
+	b.Emit(record("alone"))
+	deadline := time.Now().Add(5 * time.Second)
+	for rec.count() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if s := b.Stats(); s.Exported != 1 {
+		t.Errorf("record not exported after MaxLatency: %+v", s)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	rec := &recorder{fail: 2, err: errors.New("unavailable")}
+	b := New(rec, Config{MinBackoff: time.Millisecond})
+	b.Emit(record("retried"))
+	if err := b.Close(); err == nil {
+		t.Error("Close did not return the error of the failed attempts")
+	}
+	if s := b.Stats(); s.Exported != 1 || s.Retries != 2 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	rec := &recorder{fail: 1, err: RetryAfter(errors.New("slow down"), 20*time.Millisecond)}
+	b := New(rec, Config{MinBackoff: time.Hour})
+	b.Emit(record("later"))
+	start := time.Now()
+	b.Close()
+	if d := time.Since(start); d < 20*time.Millisecond || d > time.Minute {
+		t.Errorf("retried after %v, want 20ms", d)
+	}
+}
+
+func TestFlushTriesOnce(t *testing.T) {
+	rec := &recorder{fail: 1000, err: errors.New("unavailable")}
+	b := New(rec, Config{MinBackoff: 10 * time.Millisecond, RetryTime: time.Hour})
+	b.Emit(record("unavailable"))
+	start := time.Now()
+	if err := b.Flush(); err == nil {
+		t.Error("Flush succeeded while exporting fails")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("Flush waited %v for retries", d)
+	}
+	if s := b.Stats(); s.Failed != 0 || s.Exported != 0 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+	rec.mu.Lock()
+	rec.fail = 0
+	rec.mu.Unlock()
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if s := b.Stats(); s.Exported != 1 {
+		t.Errorf("the batch was not retried after Flush: %+v", s)
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lgbatch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "dead.json")
+	rec := &recorder{fail: 1, err: Permanent(errors.New("rejected"))}
+	b := New(rec, Config{DeadLetter: path})
+	defer b.Close()
+	r := record("lost")
+	r.Fields = []lg.Field{lg.KV("n", 1)}
+	b.Emit(r)
+	if err := b.Flush(); err == nil || err.Error() != "rejected" {
+		t.Errorf("Flush returned %v, want the permanent error", err)
+	}
+	if s := b.Stats(); s.Failed != 1 || s.DeadLettered != 1 || s.Retries != 0 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	if !s.Scan() {
+		t.Fatal("empty dead letter file")
+	}
+	var d deadRecord
+	if err := json.Unmarshal(s.Bytes(), &d); err != nil {
+		t.Fatal(err)
+	}
+	if d.Message != "lost" || d.Error != "rejected" || d.Fields["n"] != "1" {
+		t.Errorf("unexpected dead record %+v", d)
+	}
+	// The next batch goes through.
+	b.Emit(record("kept"))
+	if err := b.Flush(); err != nil {
+		t.Errorf("Flush returned %v after a successful export", err)
+	}
+}
+
+// blocker is an Exporter blocking until released.
+type blocker struct {
+	release chan struct{}
+	recorder
+}
+
+func (bl *blocker) Export(records []*lg.Record) error {
+	<-bl.release
+	return bl.recorder.Export(records)
+}
+
+func TestOverflow(t *testing.T) {
+	for _, tc := range []struct {
+		overflow Overflow
+		want     []string
+	}{
+		{DropOldest, []string{"b", "c"}},
+		{DropNewest, []string{"a", "b"}},
+	} {
+		bl := &blocker{release: make(chan struct{})}
+		b := New(bl, Config{QueueSize: 2, MaxLatency: time.Hour, Overflow: tc.overflow})
+		// Keep the dispatcher waiting for the exporter with a first batch.
+		b.Emit(record("first"))
+		go b.Flush()
+		deadline := time.Now().Add(5 * time.Second)
+		for len(b.inflightSeqs()) == 0 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		for _, msg := range []string{"a", "b", "c"} {
+			b.Emit(record(msg))
+		}
+		close(bl.release)
+		if err := b.Close(); err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, batch := range bl.batches[1:] {
+			got = append(got, batch...)
+		}
+		if len(got) != 2 || got[0] != tc.want[0] || got[1] != tc.want[1] {
+			t.Errorf("overflow %d: exported %q, want %q", tc.overflow, got, tc.want)
+		}
+		if s := b.Stats(); s.Dropped != 1 {
+			t.Errorf("overflow %d: dropped %d, want 1", tc.overflow, s.Dropped)
+		}
+	}
+}
+
+// inflightSeqs returns the batches being exported.
+func (b *Batcher) inflightSeqs() []uint64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var seqs []uint64
+	for seq := range b.inflight {
+		seqs = append(seqs, seq)
+	}
+	return seqs
+}
+
+func TestClosed(t *testing.T) {
+	b := New(&recorder{}, Config{})
+	if err := b.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Emit(record("late")); err != ErrClosed {
+		t.Errorf("Emit after Close returned %v", err)
+	}
+	if err := b.Close(); err != ErrClosed {
+		t.Errorf("second Close returned %v", err)
+	}
+}
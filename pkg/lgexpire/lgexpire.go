@@ -10,9 +10,10 @@ import (
 	"os"
 	"path/filepath"
 	"sort"
-	"strconv"
 	"strings"
 	"time"
+
+	"github.com/thomasf/lg/pkg/lgname"
 )
 
 // Expire  .
@@ -20,6 +21,7 @@ type Expire struct {
 	LogDir   string   // The directory where the log files are located
 	Programs []string // the programs to consider.
 	Rules    []Rule   // Additional rules for removal
+	Template string   // The -log_file_template of the programs, lgname.DefaultTemplate if empty
 
 	logFiles []logFile
 }
@@ -52,7 +54,7 @@ var noLogFile = logFile{}
 var validExts = map[string]bool{
 	"gz": true,
 }
-var allLevels = []string{"INFO", "WARNING", "ERROR", "FATAL"}
+var allLevels = []string{"DEBUG", "INFO", "NOTICE", "WARNING", "ERROR", "CRITICAL", "FATAL"}
 var validLevels = make(map[string]bool, 0)
 
 func init() {
@@ -68,6 +70,13 @@ func (r *Expire) Run() error {
 	if r.LogDir == "" {
 		r.LogDir = "/tmp" // TODO: do it the same way as lg does it
 	}
+	tmpl := defaultTemplate
+	if r.Template != "" {
+		var err error
+		if tmpl, err = lgname.Parse(r.Template); err != nil {
+			return err
+		}
+	}
 
 	fs, err := filepath.Glob(r.LogDir + "/*") // TODO: nothing gained by using globs
 	if err != nil {
@@ -79,7 +88,7 @@ func (r *Expire) Run() error {
 	var logFiles []logFile
 	for _, f := range fs {
 
-		lf, err := parseLogFileName(f)
+		lf, err := parseTemplateFileName(tmpl, f)
 		if err == nil {
 			logFiles = append(logFiles, lf)
 		}
@@ -103,62 +112,51 @@ func (r *Expire) Run() error {
 
 var ErrNotLgFile = errors.New("non a lg log file name")
 
+var defaultTemplate = lgname.MustParse(lgname.DefaultTemplate)
+
+// parseLogFileName parses filename according to lgname.DefaultTemplate.
 func parseLogFileName(filename string) (logFile, error) {
+	return parseTemplateFileName(defaultTemplate, filename)
+}
+
+// parseTemplateFileName parses filename according to tmpl. If tmpl lacks the
+// time field, the modification time of the file is used instead.
+func parseTemplateFileName(tmpl *lgname.Template, filename string) (logFile, error) {
 	basename := filepath.Base(filename)
-	fields := strings.Split(basename, ".")
 
 	var ext string
-	{
-		if validExts[fields[len(fields)-1]] {
-			ext = fields[len(fields)-1]
-			fields = fields[:len(fields)-1]
-		}
-	}
-
-	if len(fields) < 7 {
-		return noLogFile, ErrNotLgFile
+	if i := strings.LastIndex(basename, "."); i >= 0 && validExts[basename[i+1:]] {
+		ext = basename[i+1:]
+		basename = basename[:i]
 	}
 
-	if fields[len(fields)-4] != "log" {
+	// The times in file names have always been read as UTC here.
+	n, err := tmpl.MatchIn(basename, time.UTC)
+	if err == lgname.ErrNoMatch {
 		return noLogFile, ErrNotLgFile
+	} else if err != nil {
+		return noLogFile, err
 	}
-
-	var pid uint64
-	{
-		var err error
-		pidStr := fields[len(fields)-1]
-		pid, err = strconv.ParseUint(pidStr, 10, 64)
-		if err != nil {
-			log.Printf("invalid pid %s in %s: %v", pidStr, filename, err)
-		}
+	if !validLevels[n.Tag] {
+		return noLogFile, fmt.Errorf("%s is not a supprted log level", n.Tag)
 	}
-
-	var timestamp time.Time
-	{
-		var err error
-		timestamp, err = time.Parse("20060102-150405", fields[len(fields)-2])
+	if !tmpl.Has("time") {
+		fi, err := os.Stat(filename)
 		if err != nil {
-			return noLogFile, fmt.Errorf("invalid date: %s", err)
-		}
-	}
-
-	var level string
-	{
-		level = fields[len(fields)-3]
-		if !validLevels[level] {
-			return noLogFile, fmt.Errorf("%s is not a supprted log level", level)
+			return noLogFile, err
 		}
+		n.Time = fi.ModTime()
 	}
 
 	v := logFile{
 		Filename: filename,
-		Program:  strings.Join(fields[0:len(fields)-6], "."),
-		Host:     fields[len(fields)-6],
-		Username: fields[len(fields)-5],
-		Level:    level,
-		Time:     timestamp,
+		Program:  n.Program,
+		Host:     n.Host,
+		Username: n.User,
+		Level:    n.Tag,
+		Time:     n.Time,
 		Ext:      ext,
-		Pid:      pid,
+		Pid:      uint64(n.Pid),
 	}
 
 	return v, nil
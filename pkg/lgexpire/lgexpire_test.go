@@ -10,6 +10,8 @@ import (
 	"strings"
 	"testing"
 	"time"
+
+	"github.com/thomasf/lg/pkg/lgname"
 )
 
 func TestLogFileNameParsing(t *testing.T) {
@@ -70,6 +72,26 @@ func TestLogFileNameParsing(t *testing.T) {
 	}
 }
 
+func TestTemplateFileNameParsing(t *testing.T) {
+	// The times are read as UTC whatever the local time zone.
+	defer func(previous *time.Location) { time.Local = previous }(time.Local)
+	time.Local = time.FixedZone("UTC+1", 3600)
+	tmpl, err := lgname.Parse("{program}-{tag}-{time}.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	lf, err := parseTemplateFileName(tmpl, "/var/log/my-app-ERROR-20160522-103338.log.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := time.Date(2016, 5, 22, 10, 33, 38, 0, time.UTC); lf.Program != "my-app" || lf.Level != "ERROR" || lf.Ext != "gz" || !lf.Time.Equal(want) {
+		t.Errorf("unexpected fields: %+v", lf)
+	}
+	if _, err := parseTemplateFileName(tmpl, "my-app.ERROR"); err != ErrNotLgFile {
+		t.Errorf("expected ErrNotLgFile, got %v", err)
+	}
+}
+
 func TestRotate(t *testing.T) {
 
 	// only one file of each level should remainc
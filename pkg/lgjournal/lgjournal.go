@@ -0,0 +1,221 @@
+// Package lgjournal sends lg log lines to the systemd journal using its
+// native protocol, so that their location and fields can be queried:
+//
+//	journalctl -p err CODE_FILE=server.go REQUEST_ID=r1
+//
+// Install sets it up for a program run by systemd:
+//
+//	if err := lgjournal.Install("INFO"); err != nil {
+//		lg.Error(err)
+//	}
+//
+// Each entry has the fields MESSAGE, PRIORITY, CODE_FILE, CODE_LINE,
+// CODE_FUNC and SYSLOG_IDENTIFIER, followed by the fields of the record with
+// their names converted to journal field names, such as REQUEST_ID for
+// request_id. Record fields named like the fields above are prefixed with
+// FIELD_, so that a message field becomes FIELD_MESSAGE.
+package lgjournal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/thomasf/lg"
+)
+
+// DefaultPath is the native protocol socket of journald.
+const DefaultPath = "/run/systemd/journal/socket"
+
+// Config configures a Writer. The zero value is ready for use.
+type Config struct {
+	Path       string // The journald socket, DefaultPath if empty
+	Identifier string // The SYSLOG_IDENTIFIER, lg.ProgramName() if empty
+}
+
+// Writer is an lg.Sink writing records to the journal.
+type Writer struct {
+	conn  *net.UnixConn
+	ident string
+
+	mu     sync.Mutex // Serializes the use of buf.
+	buf    []byte
+	closed bool
+}
+
+// New returns a Writer for the journal of cfg.
+func New(cfg Config) (*Writer, error) {
+	if cfg.Path == "" {
+		cfg.Path = DefaultPath
+	}
+	if cfg.Identifier == "" {
+		cfg.Identifier = lg.ProgramName()
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: cfg.Path, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{conn: conn, ident: cfg.Identifier}, nil
+}
+
+// Install adds a Writer for the local journal as a sink for the lines of the
+// named severity and above. If standard error is connected to the journal
+// already, as reported by StderrIsJournal, it also stops lg from writing to
+// standard error, so that lines are not logged twice.
+func Install(severity string) error {
+	w, err := New(Config{})
+	if err != nil {
+		return err
+	}
+	if err := lg.AddSink(w, severity); err != nil {
+		w.Close()
+		return err
+	}
+	if StderrIsJournal() {
+		lg.SetStderr(false)
+	}
+	return nil
+}
+
+// StderrIsJournal reports whether standard error is connected to the
+// journal, as systemd indicates with the JOURNAL_STREAM environment variable.
+// It is only ever true on Linux.
+func StderrIsJournal() bool {
+	return stderrIsJournal()
+}
+
+// stderrIsJournal implements StderrIsJournal, where supported.
+var stderrIsJournal = func() bool { return false }
+
+// sendFile sends an entry too large for a datagram by passing a file
+// holding it, where supported.
+var sendFile func(conn *net.UnixConn, entry []byte) error
+
+// priority maps the lg severities to syslog priorities.
+var priority = map[string]string{
+	"DEBUG":    "7", // debug
+	"INFO":     "6", // informational
+	"NOTICE":   "5", // notice
+	"WARNING":  "4", // warning
+	"ERROR":    "3", // error
+	"CRITICAL": "2", // critical
+	"FATAL":    "1", // alert
+}
+
+var errClosed = errors.New("lgjournal: writer closed")
+
+// Emit is part of the lg.Sink interface. It writes r to the journal.
+func (w *Writer) Emit(r *lg.Record) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return errClosed
+	}
+	prio, ok := priority[r.Severity]
+	if !ok {
+		prio = priority["INFO"]
+	}
+	b := w.buf[:0]
+	b = appendField(b, "MESSAGE", r.Message)
+	b = appendField(b, "PRIORITY", prio)
+	b = appendField(b, "CODE_FILE", r.File)
+	b = appendField(b, "CODE_LINE", strconv.Itoa(r.Line))
+	if r.Func != "" {
+		b = appendField(b, "CODE_FUNC", r.Func)
+	}
+	b = appendField(b, "SYSLOG_IDENTIFIER", w.ident)
+	for _, f := range r.Fields {
+		b = appendField(b, FieldName(f.Key), fmt.Sprint(f.Value))
+	}
+	w.buf = b
+	_, err := w.conn.Write(b)
+	if isTooLarge(err) && sendFile != nil {
+		err = sendFile(w.conn, b)
+	}
+	return err
+}
+
+// isTooLarge reports whether err is the error of writing a datagram which is
+// too large for the socket.
+func isTooLarge(err error) bool {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+	return errno == syscall.EMSGSIZE || errno == syscall.ENOBUFS
+}
+
+// Flush is part of the lg.Sink interface. Entries are not buffered, so it
+// does nothing.
+func (w *Writer) Flush() error {
+	return nil
+}
+
+// Close is part of the lg.Sink interface. It closes the socket.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return errClosed
+	}
+	w.closed = true
+	return w.conn.Close()
+}
+
+// appendField appends the field name=value to an entry, using the binary
+// encoding for values containing newlines.
+func appendField(b []byte, name, value string) []byte {
+	b = append(b, name...)
+	if strings.IndexByte(value, '\n') < 0 {
+		b = append(b, '=')
+		b = append(b, value...)
+		return append(b, '\n')
+	}
+	var size [8]byte
+	binary.LittleEndian.PutUint64(size[:], uint64(len(value)))
+	b = append(b, '\n')
+	b = append(b, size[:]...)
+	b = append(b, value...)
+	return append(b, '\n')
+}
+
+// reservedFields are the fields Emit writes for every entry.
+var reservedFields = map[string]bool{
+	"MESSAGE":           true,
+	"PRIORITY":          true,
+	"CODE_FILE":         true,
+	"CODE_LINE":         true,
+	"CODE_FUNC":         true,
+	"SYSLOG_IDENTIFIER": true,
+}
+
+// FieldName returns key as a journal field name: upper case letters, digits
+// and underscores, starting with a letter and at most 64 characters long.
+// Characters which are not allowed become underscores, and names which would
+// start with something else than a letter or are among the fields written for
+// every entry are prefixed with FIELD_.
+func FieldName(key string) string {
+	b := make([]byte, 0, len(key))
+	for i := 0; i < len(key); i++ {
+		switch c := key[i]; {
+		case 'a' <= c && c <= 'z':
+			b = append(b, c-'a'+'A')
+		case 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+			b = append(b, c)
+		default:
+			b = append(b, '_')
+		}
+	}
+	if len(b) == 0 || b[0] < 'A' || b[0] > 'Z' || reservedFields[string(b)] {
+		b = append([]byte("FIELD_"), b...)
+	}
+	if len(b) > 64 {
+		b = b[:64]
+	}
+	return string(b)
+}
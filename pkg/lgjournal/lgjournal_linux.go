@@ -0,0 +1,57 @@
+package lgjournal
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"syscall"
+)
+
+func init() {
+	stderrIsJournal = linuxStderrIsJournal
+	sendFile = sendTempFile
+}
+
+// linuxStderrIsJournal compares the device and inode of standard error with
+// those of the journal stream given in JOURNAL_STREAM.
+func linuxStderrIsJournal() bool {
+	var dev, ino uint64
+	if _, err := fmt.Sscanf(os.Getenv("JOURNAL_STREAM"), "%d:%d", &dev, &ino); err != nil {
+		return false
+	}
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(os.Stderr.Fd()), &st); err != nil {
+		return false
+	}
+	return uint64(st.Dev) == dev && uint64(st.Ino) == ino
+}
+
+// sendTempFile writes entry to an unlinked file in /dev/shm and passes its
+// descriptor to journald, which reads the entry from it.
+func sendTempFile(conn *net.UnixConn, entry []byte) error {
+	f, err := ioutil.TempFile("/dev/shm", "lgjournal")
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := os.Remove(f.Name()); err != nil {
+		return err
+	}
+	if _, err := f.Write(entry); err != nil {
+		return err
+	}
+	// WriteMsgUnix refuses connected sockets, so use sendmsg directly.
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	rights := syscall.UnixRights(int(f.Fd()))
+	if werr := raw.Write(func(fd uintptr) bool {
+		err = syscall.Sendmsg(int(fd), nil, rights, nil, 0)
+		return err != syscall.EAGAIN
+	}); werr != nil {
+		return werr
+	}
+	return err
+}
@@ -0,0 +1,66 @@
+package lgjournal
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestStderrIsJournal(t *testing.T) {
+	defer os.Setenv("JOURNAL_STREAM", os.Getenv("JOURNAL_STREAM"))
+	os.Setenv("JOURNAL_STREAM", "")
+	if StderrIsJournal() {
+		t.Error("StderrIsJournal without JOURNAL_STREAM")
+	}
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(os.Stderr.Fd()), &st); err != nil {
+		t.Skip(err)
+	}
+	os.Setenv("JOURNAL_STREAM", fmt.Sprintf("%d:%d", st.Dev, st.Ino))
+	if !StderrIsJournal() {
+		t.Error("StderrIsJournal false with matching JOURNAL_STREAM")
+	}
+}
+
+// Test that entries too large for a datagram are passed in a file.
+func TestSendTempFile(t *testing.T) {
+	l, path := listen(t)
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	entry := appendField(nil, "MESSAGE", "large")
+	if err := sendTempFile(conn, entry); err != nil {
+		t.Skip(err) // No /dev/shm.
+	}
+	l.SetReadDeadline(time.Now().Add(5 * time.Second))
+	oob := make([]byte, syscall.CmsgSpace(4))
+	_, oobn, _, _, err := l.ReadMsgUnix(nil, oob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil || len(msgs) != 1 {
+		t.Fatalf("no control message: %v", err)
+	}
+	fds, err := syscall.ParseUnixRights(&msgs[0])
+	if err != nil || len(fds) != 1 {
+		t.Fatalf("no descriptor: %v", err)
+	}
+	f := os.NewFile(uintptr(fds[0]), "entry")
+	defer f.Close()
+	// journald reads from the start, whatever the offset left by the writer.
+	data, err := ioutil.ReadAll(io.NewSectionReader(f, 0, 1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(entry) {
+		t.Errorf("file holds %q, want %q", data, entry)
+	}
+}
@@ -0,0 +1,128 @@
+package lgjournal
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/thomasf/lg"
+)
+
+// listen returns a unixgram listener standing in for journald.
+func listen(t *testing.T) (*net.UnixConn, string) {
+	dir, err := ioutil.TempDir("", "lgjournal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "socket")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Skip(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, path
+}
+
+// parseEntry decodes an entry of the native protocol.
+func parseEntry(t *testing.T, b []byte) map[string]string {
+	fields := map[string]string{}
+	for len(b) > 0 {
+		nl := bytes.IndexByte(b, '\n')
+		if nl < 0 {
+			t.Fatalf("unterminated field %q", b)
+		}
+		if eq := bytes.IndexByte(b[:nl], '='); eq >= 0 {
+			if _, ok := fields[string(b[:eq])]; ok {
+				t.Errorf("duplicate field %s", b[:eq])
+			}
+			fields[string(b[:eq])] = string(b[eq+1 : nl])
+			b = b[nl+1:]
+			continue
+		}
+		name := string(b[:nl])
+		if _, ok := fields[name]; ok {
+			t.Errorf("duplicate field %s", name)
+		}
+		b = b[nl+1:]
+		size := binary.LittleEndian.Uint64(b[:8])
+		fields[name] = string(b[8 : 8+size])
+		if b[8+size] != '\n' {
+			t.Fatalf("binary field %s not terminated", name)
+		}
+		b = b[8+size+1:]
+	}
+	return fields
+}
+
+func TestEmit(t *testing.T) {
+	l, path := listen(t)
+	w, err := New(Config{Path: path, Identifier: "app"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	r := &lg.Record{
+		Time:     time.Now(),
+		Severity: "ERROR",
+		File:     "server.go",
+		Line:     42,
+		Func:     "main.serve",
+		Message:  "failed\nbadly",
+		Fields:   []lg.Field{lg.KV("request_id", "r1"), lg.KV("n", 3), lg.KV("message", "shadowed")},
+	}
+	if err := w.Emit(r); err != nil {
+		t.Fatal(err)
+	}
+	l.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4096)
+	n, err := l.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"MESSAGE":           "failed\nbadly",
+		"PRIORITY":          "3",
+		"CODE_FILE":         "server.go",
+		"CODE_LINE":         "42",
+		"CODE_FUNC":         "main.serve",
+		"SYSLOG_IDENTIFIER": "app",
+		"REQUEST_ID":        "r1",
+		"N":                 "3",
+		"FIELD_MESSAGE":     "shadowed",
+	}
+	if got := parseEntry(t, buf[:n]); fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("got entry %q, want %q", got, want)
+	}
+	w.Close()
+	if err := w.Emit(r); err == nil {
+		t.Error("Emit succeeded after Close")
+	}
+}
+
+func TestFieldName(t *testing.T) {
+	for key, want := range map[string]string{
+		"request_id":        "REQUEST_ID",
+		"http.path":         "HTTP_PATH",
+		"_private":          "FIELD__PRIVATE",
+		"2xx":               "FIELD_2XX",
+		"":                  "FIELD_",
+		"message":           "FIELD_MESSAGE",
+		"Priority":          "FIELD_PRIORITY",
+		"code_file":         "FIELD_CODE_FILE",
+		"syslog_identifier": "FIELD_SYSLOG_IDENTIFIER",
+	} {
+		if got := FieldName(key); got != want {
+			t.Errorf("FieldName(%q) = %q, want %q", key, got, want)
+		}
+	}
+	if got := FieldName(string(make([]byte, 100))); len(got) != 64 {
+		t.Errorf("FieldName returned %d characters, want 64", len(got))
+	}
+}
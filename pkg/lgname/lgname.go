@@ -0,0 +1,201 @@
+// Package lgname formats and parses the names of lg log files according to a
+// template, so that tools such as lgexpire recognize the files lg creates.
+//
+// A template is a file name in which fields are written in braces, the
+// default being
+//
+//	{program}.{host}.{user}.log.{tag}.{time}.{pid}
+//
+// The fields are program, host, user, tag (the severity, such as INFO), time
+// (formatted as 20060102-150405), pid and seq (the number of files the
+// process created before for the same tag).
+package lgname
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Name holds the fields of a log file name.
+type Name struct {
+	Program string
+	Host    string
+	User    string
+	Tag     string    // The severity: INFO, WARNING, ERROR or FATAL
+	Time    time.Time // The time the file was created, to the second
+	Pid     int
+	Seq     int // The number of files created before for Tag
+}
+
+const (
+	// DefaultTemplate is the template of the log files lg creates by default.
+	DefaultTemplate = "{program}.{host}.{user}.log.{tag}.{time}.{pid}"
+	// DefaultLinkTemplate is the template of the symlinks to the latest log
+	// files lg creates by default.
+	DefaultLinkTemplate = "{program}.{tag}"
+)
+
+// TimeLayout is the layout of the time field, as in time.Format.
+const TimeLayout = "20060102-150405"
+
+// fieldPatterns are the regular expressions matching each field. The program
+// name may contain dots and is matched greedily, while host and user may not.
+var fieldPatterns = map[string]string{
+	"program": `.+`,
+	"host":    `[^.]+`,
+	"user":    `[^.]+`,
+	"tag":     `[A-Z]+`,
+	"time":    `\d{8}-\d{6}`,
+	"pid":     `\d+`,
+	"seq":     `\d+`,
+}
+
+// ErrNoMatch is returned by Template.Match for names which do not match the
+// template.
+var ErrNoMatch = errors.New("lgname: file name does not match the template")
+
+// Template is a parsed file name template.
+type Template struct {
+	text   string
+	parts  []string // Literals at even indexes, field names at odd ones
+	re     *regexp.Regexp
+	fields []string // The field of each submatch of re
+}
+
+// Parse parses a file name template.
+func Parse(text string) (*Template, error) {
+	if strings.Contains(text, "/") {
+		return nil, fmt.Errorf("lgname: template %q contains a /", text)
+	}
+	t := &Template{text: text}
+	var pattern strings.Builder
+	pattern.WriteString("^")
+	rest := text
+	for {
+		open := strings.IndexByte(rest, '{')
+		if open < 0 {
+			break
+		}
+		end := strings.IndexByte(rest[open:], '}')
+		if end < 0 {
+			return nil, fmt.Errorf("lgname: unclosed { in template %q", text)
+		}
+		if strings.Contains(rest[:open], "}") {
+			return nil, fmt.Errorf("lgname: unexpected } in template %q", text)
+		}
+		field := rest[open+1 : open+end]
+		fp, ok := fieldPatterns[field]
+		if !ok {
+			return nil, fmt.Errorf("lgname: unknown field {%s} in template %q", field, text)
+		}
+		t.parts = append(t.parts, rest[:open], field)
+		t.fields = append(t.fields, field)
+		pattern.WriteString(regexp.QuoteMeta(rest[:open]))
+		pattern.WriteString("(" + fp + ")")
+		rest = rest[open+end+1:]
+	}
+	if strings.Contains(rest, "}") {
+		return nil, fmt.Errorf("lgname: unexpected } in template %q", text)
+	}
+	t.parts = append(t.parts, rest)
+	pattern.WriteString(regexp.QuoteMeta(rest))
+	pattern.WriteString("$")
+	t.re = regexp.MustCompile(pattern.String())
+	return t, nil
+}
+
+// MustParse is like Parse but panics if the template cannot be parsed.
+func MustParse(text string) *Template {
+	t, err := Parse(text)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// String returns the text of the template.
+func (t *Template) String() string {
+	return t.text
+}
+
+// Has reports whether the template contains field.
+func (t *Template) Has(field string) bool {
+	for _, f := range t.fields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// Format returns the file name for n.
+func (t *Template) Format(n Name) string {
+	var b strings.Builder
+	for i, part := range t.parts {
+		if i%2 == 0 {
+			b.WriteString(part)
+			continue
+		}
+		switch part {
+		case "program":
+			b.WriteString(n.Program)
+		case "host":
+			b.WriteString(n.Host)
+		case "user":
+			b.WriteString(n.User)
+		case "tag":
+			b.WriteString(n.Tag)
+		case "time":
+			b.WriteString(n.Time.Format(TimeLayout))
+		case "pid":
+			b.WriteString(strconv.Itoa(n.Pid))
+		case "seq":
+			b.WriteString(strconv.Itoa(n.Seq))
+		}
+	}
+	return b.String()
+}
+
+// Match parses name, a file base name, according to the template. Fields
+// missing from the template are left zero. The time is in the local time zone,
+// as lg formats it.
+func (t *Template) Match(name string) (Name, error) {
+	return t.MatchIn(name, time.Local)
+}
+
+// MatchIn is like Match but reads the time in loc.
+func (t *Template) MatchIn(name string, loc *time.Location) (Name, error) {
+	m := t.re.FindStringSubmatch(name)
+	if m == nil {
+		return Name{}, ErrNoMatch
+	}
+	var n Name
+	for i, field := range t.fields {
+		v := m[i+1]
+		var err error
+		switch field {
+		case "program":
+			n.Program = v
+		case "host":
+			n.Host = v
+		case "user":
+			n.User = v
+		case "tag":
+			n.Tag = v
+		case "time":
+			n.Time, err = time.ParseInLocation(TimeLayout, v, loc)
+		case "pid":
+			n.Pid, err = strconv.Atoi(v)
+		case "seq":
+			n.Seq, err = strconv.Atoi(v)
+		}
+		if err != nil {
+			return Name{}, fmt.Errorf("lgname: invalid %s in %s: %v", field, name, err)
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,71 @@
+package lgname
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFormatMatch(t *testing.T) {
+	now := time.Date(2016, 5, 22, 10, 33, 38, 0, time.Local)
+	for _, test := range []struct {
+		template string
+		name     Name
+		file     string
+	}{
+		{
+			DefaultTemplate,
+			Name{Program: "very.cool.program", Host: "coolhost", User: "root", Tag: "INFO", Time: now, Pid: 8664},
+			"very.cool.program.coolhost.root.log.INFO.20160522-103338.8664",
+		},
+		{
+			DefaultLinkTemplate,
+			Name{Program: "app", Tag: "ERROR"},
+			"app.ERROR",
+		},
+		{
+			"{program}-{tag}-{time}-{seq}.log",
+			Name{Program: "my-app", Tag: "WARNING", Time: now, Seq: 3},
+			"my-app-WARNING-20160522-103338-3.log",
+		},
+	} {
+		tmpl, err := Parse(test.template)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := tmpl.Format(test.name); got != test.file {
+			t.Errorf("%s: Format: expected %s, got %s", test.template, test.file, got)
+		}
+		n, err := tmpl.Match(test.file)
+		if err != nil {
+			t.Errorf("%s: Match(%s): %v", test.template, test.file, err)
+		} else if n != test.name {
+			t.Errorf("%s: Match(%s): expected %+v, got %+v", test.template, test.file, test.name, n)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, template := range []string{
+		"{program",
+		"{prog}.{tag}",
+		"{program}}.{tag}",
+		"logs/{program}.{tag}",
+	} {
+		if _, err := Parse(template); err == nil {
+			t.Errorf("Parse(%q) succeeded", template)
+		}
+	}
+}
+
+func TestMatchErrors(t *testing.T) {
+	tmpl := MustParse(DefaultTemplate)
+	for _, name := range []string{
+		"very-cool-program.coolhost.cooluser.log.ERROR.20160522-103338",
+		"very-cool-program.FATAL",
+		"program.host.user.log.INFO.20161322-103338.1",
+	} {
+		if _, err := tmpl.Match(name); err == nil {
+			t.Errorf("Match(%q) succeeded", name)
+		}
+	}
+}
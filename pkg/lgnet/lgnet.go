@@ -0,0 +1,531 @@
+// Package lgnet streams lg log lines to a remote TCP or UDP endpoint as
+// newline delimited text or JSON, for hosts without a log agent:
+//
+//	w, err := lgnet.New(lgnet.Config{Network: "tcp", Addr: "logs.example.com:5140", Format: lgnet.JSON})
+//	if err != nil {
+//		lg.Fatal(err)
+//	}
+//	lg.AddSink(w, "INFO")
+//
+// Lines are written from a separate goroutine. While the endpoint cannot be
+// reached, they are kept in memory, or in a spool file if Config.SpoolDir is
+// set, and the connection is retried with exponential backoff. Delivery is at
+// least once: lines being written when a connection fails are sent again.
+package lgnet
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/thomasf/lg"
+)
+
+// Format is the encoding of the lines sent.
+type Format int
+
+const (
+	// Text sends the lines as written to the log files. Multi-line messages
+	// span several lines.
+	Text Format = iota
+	// JSON sends one JSON object per line, with the keys time, severity,
+	// host, program, file, line, func, message and fields.
+	JSON
+)
+
+// Config configures a Writer. Network and Addr are required.
+type Config struct {
+	Network string      // "tcp" or "udp"
+	Addr    string      // The address of the endpoint, as in net.Dial
+	TLS     *tls.Config // If set, TCP connections use TLS with this configuration
+	Format  Format      // The encoding of the lines
+
+	QueueSize     int    // The maximum number of lines kept in memory, 10000 if zero
+	SpoolDir      string // If set, lines are spooled to a file in this directory while disconnected, see New
+	SpoolMaxBytes int64  // The maximum size of the spool file, 64 MiB if zero
+
+	MinBackoff time.Duration // The first delay before reconnecting, 100ms if zero
+	MaxBackoff time.Duration // The longest delay before reconnecting, one minute if zero
+}
+
+// Stats are the delivery counters of a Writer.
+type Stats struct {
+	Sent       int64 // Lines written to the endpoint
+	Spooled    int64 // Lines written to the spool file
+	Dropped    int64 // Lines dropped because the queue or the spool file was full, they did not fit in a datagram, or Close left them unsent
+	Failures   int64 // Failures connecting or writing to the endpoint
+	Reconnects int64 // Connections established after a failure
+}
+
+// Writer is an lg.Sink streaming records to a remote endpoint.
+type Writer struct {
+	cfg       Config
+	host      string
+	spoolPath string
+	spoolLock *os.File // Locked while w uses the spool file
+	stats     Stats    // Handled atomically.
+
+	mu      sync.Mutex
+	queue   [][]byte
+	flushes []chan error  // Flush calls waiting for the queue to be written
+	closed  bool          // Close was called
+	wake    chan struct{} // Signals the writer goroutine, buffered
+	done    chan struct{} // Closed when the writer goroutine returns
+
+	// Owned by the writer goroutine.
+	conn      net.Conn
+	connected bool // A connection was ever established
+}
+
+// ErrClosed is returned by the methods of a Writer after Close.
+var ErrClosed = errors.New("lgnet: writer closed")
+
+// lockFile takes an exclusive lock on f, held until f is closed, or does
+// nothing on platforms without file locks, where fileLocks is false.
+var (
+	lockFile  = func(f *os.File) error { return nil }
+	fileLocks = false
+)
+
+// errDisconnected is returned by Flush while the endpoint cannot be reached.
+var errDisconnected = errors.New("lgnet: not connected")
+
+// writeTimeout bounds how long a stalled endpoint blocks the writer goroutine.
+const writeTimeout = 10 * time.Second
+
+// New returns a Writer for cfg and starts its writer goroutine, which
+// connects to the endpoint. It does not wait for the connection.
+//
+// The spool file is named after the program, so that a process sends what
+// an earlier run of the program left in it. Each Writer locks it, where the
+// platform supports file locks, and New fails if another Writer, of this or
+// another process, uses the same Config.SpoolDir.
+func New(cfg Config) (*Writer, error) {
+	switch cfg.Network {
+	case "tcp", "tcp4", "tcp6":
+	case "udp", "udp4", "udp6":
+		if cfg.TLS != nil {
+			return nil, errors.New("lgnet: TLS requires TCP")
+		}
+	default:
+		return nil, fmt.Errorf("lgnet: unsupported network %q", cfg.Network)
+	}
+	if cfg.QueueSize <= 0 {
+		cfg.QueueSize = 10000
+	}
+	if cfg.SpoolMaxBytes <= 0 {
+		cfg.SpoolMaxBytes = 64 << 20
+	}
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = 100 * time.Millisecond
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = time.Minute
+	}
+	w := &Writer{
+		cfg:  cfg,
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+	w.host, _ = os.Hostname()
+	if cfg.SpoolDir != "" {
+		if err := os.MkdirAll(cfg.SpoolDir, 0755); err != nil {
+			return nil, err
+		}
+		w.spoolPath = filepath.Join(cfg.SpoolDir, lg.ProgramName()+".lgnet.spool")
+		lock, err := os.OpenFile(w.spoolPath+".lock", os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, err
+		}
+		if err := lockFile(lock); err != nil {
+			lock.Close()
+			return nil, fmt.Errorf("lgnet: spool file %s is in use: %v", w.spoolPath, err)
+		}
+		w.spoolLock = lock
+	}
+	go w.run()
+	w.signal() // Connect, and send what a previous run spooled.
+	return w, nil
+}
+
+// Emit is part of the lg.Sink interface. It queues r, dropping the oldest
+// line if the queue is full.
+func (w *Writer) Emit(r *lg.Record) error {
+	line, err := w.encode(r)
+	if err != nil {
+		return err
+	}
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return ErrClosed
+	}
+	if len(w.queue) >= w.cfg.QueueSize {
+		w.queue[0] = nil
+		w.queue = w.queue[1:]
+		atomic.AddInt64(&w.stats.Dropped, 1)
+	}
+	w.queue = append(w.queue, line)
+	w.mu.Unlock()
+	w.signal()
+	return nil
+}
+
+// Flush is part of the lg.Sink interface. It waits for the queued lines to
+// be written, and fails without waiting while the endpoint cannot be reached.
+func (w *Writer) Flush() error {
+	ch := make(chan error, 1)
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return ErrClosed
+	}
+	w.flushes = append(w.flushes, ch)
+	w.mu.Unlock()
+	w.signal()
+	return <-ch
+}
+
+// Close is part of the lg.Sink interface. It makes a last attempt to write
+// the queued lines, spools those it could not if Config.SpoolDir is set, and
+// closes the connection. The lines neither written nor spooled are counted as
+// dropped.
+func (w *Writer) Close() error {
+	ch := make(chan error, 1)
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return ErrClosed
+	}
+	w.closed = true
+	w.flushes = append(w.flushes, ch)
+	w.mu.Unlock()
+	w.signal()
+	<-w.done
+	if w.spoolLock != nil {
+		w.spoolLock.Close() // ignore error
+	}
+	return <-ch
+}
+
+// Stats returns the delivery counters of w.
+func (w *Writer) Stats() Stats {
+	return Stats{
+		Sent:       atomic.LoadInt64(&w.stats.Sent),
+		Spooled:    atomic.LoadInt64(&w.stats.Spooled),
+		Dropped:    atomic.LoadInt64(&w.stats.Dropped),
+		Failures:   atomic.LoadInt64(&w.stats.Failures),
+		Reconnects: atomic.LoadInt64(&w.stats.Reconnects),
+	}
+}
+
+// signal wakes the writer goroutine.
+func (w *Writer) signal() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// run is the writer goroutine. It writes the queued lines while connected,
+// and otherwise reconnects after a backoff, spooling the queued lines when
+// that fails or once they fill half the queue.
+func (w *Writer) run() {
+	defer close(w.done)
+	backoff := w.cfg.MinBackoff
+	var retry <-chan time.Time
+	for {
+		select {
+		case <-w.wake:
+		case <-retry:
+			retry = nil
+		}
+		w.mu.Lock()
+		flushes, closed := w.flushes, w.closed
+		w.flushes = nil
+		w.mu.Unlock()
+		var err error
+		if retry != nil && !closed {
+			// Still backing off.
+			err = errDisconnected
+			if w.spoolPath != "" && w.queued() >= w.cfg.QueueSize/2 {
+				w.spool(w.take())
+			}
+		} else if err = w.deliver(); err != nil {
+			atomic.AddInt64(&w.stats.Failures, 1)
+			w.spool(w.take())
+			retry = time.After(backoff)
+			if backoff *= 2; backoff > w.cfg.MaxBackoff {
+				backoff = w.cfg.MaxBackoff
+			}
+		} else {
+			backoff = w.cfg.MinBackoff
+		}
+		for _, ch := range flushes {
+			ch <- err
+		}
+		if closed {
+			if lines := w.take(); len(lines) > 0 {
+				atomic.AddInt64(&w.stats.Dropped, int64(len(lines)))
+			}
+			if w.conn != nil {
+				w.conn.Close() // ignore error
+			}
+			return
+		}
+	}
+}
+
+// queued returns the number of queued lines.
+func (w *Writer) queued() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.queue)
+}
+
+// take removes and returns the queued lines.
+func (w *Writer) take() [][]byte {
+	w.mu.Lock()
+	lines := w.queue
+	w.queue = nil
+	w.mu.Unlock()
+	return lines
+}
+
+// putBack queues lines which could not be written before those queued since,
+// dropping the oldest beyond Config.QueueSize.
+func (w *Writer) putBack(lines [][]byte) {
+	w.mu.Lock()
+	lines = append(lines, w.queue...)
+	if n := len(lines) - w.cfg.QueueSize; n > 0 {
+		atomic.AddInt64(&w.stats.Dropped, int64(n))
+		lines = lines[n:]
+	}
+	w.queue = lines
+	w.mu.Unlock()
+}
+
+// deliver connects if needed and writes the spool file, then the queued
+// lines, until the queue is empty.
+func (w *Writer) deliver() error {
+	if w.conn == nil {
+		conn, err := w.dial()
+		if err != nil {
+			return err
+		}
+		if w.connected {
+			atomic.AddInt64(&w.stats.Reconnects, 1)
+		}
+		w.conn, w.connected = conn, true
+	}
+	if err := w.unspool(); err != nil {
+		return w.fail(err)
+	}
+	for {
+		lines := w.take()
+		if len(lines) == 0 {
+			return nil
+		}
+		if n, err := w.write(lines); err != nil {
+			w.putBack(lines[n:])
+			return w.fail(err)
+		}
+	}
+}
+
+// fail closes the connection after err.
+func (w *Writer) fail(err error) error {
+	w.conn.Close() // ignore error
+	w.conn = nil
+	return err
+}
+
+// dial connects to the endpoint.
+func (w *Writer) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: writeTimeout}
+	if w.cfg.TLS != nil {
+		return tls.DialWithDialer(dialer, w.cfg.Network, w.cfg.Addr, w.cfg.TLS)
+	}
+	return dialer.Dial(w.cfg.Network, w.cfg.Addr)
+}
+
+// maxDatagram is the largest UDP payload over IPv4.
+const maxDatagram = 65507
+
+// write writes lines to the connection, as one stream write over TCP and one
+// datagram per line over UDP, and counts them as sent. Lines which do not fit
+// in a datagram are dropped, since retrying cannot help. On failure, write
+// returns the number of lines at the start of lines which were handled.
+func (w *Writer) write(lines [][]byte) (int, error) {
+	w.conn.SetWriteDeadline(time.Now().Add(writeTimeout)) // ignore error
+	if _, ok := w.conn.(net.PacketConn); ok {
+		for i, line := range lines {
+			if len(line) > maxDatagram {
+				atomic.AddInt64(&w.stats.Dropped, 1)
+				continue
+			}
+			if _, err := w.conn.Write(line); err != nil {
+				if errors.Is(err, syscall.EMSGSIZE) {
+					atomic.AddInt64(&w.stats.Dropped, 1)
+					continue
+				}
+				return i, err
+			}
+			atomic.AddInt64(&w.stats.Sent, 1)
+		}
+		return len(lines), nil
+	}
+	// WriteTo consumes the buffers, which are put back on failure.
+	bufs := append(net.Buffers(nil), lines...)
+	if _, err := bufs.WriteTo(w.conn); err != nil {
+		return 0, err
+	}
+	atomic.AddInt64(&w.stats.Sent, int64(len(lines)))
+	return len(lines), nil
+}
+
+// spool appends lines to the spool file, or puts them back in the queue
+// without one.
+func (w *Writer) spool(lines [][]byte) {
+	if len(lines) == 0 {
+		return
+	}
+	if w.spoolPath == "" {
+		w.putBack(lines)
+		return
+	}
+	f, err := os.OpenFile(w.spoolPath, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		w.putBack(lines)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		w.putBack(lines)
+		return
+	}
+	size := fi.Size()
+	bw := bufio.NewWriter(f)
+	for i, line := range lines {
+		if size+int64(len(line)) > w.cfg.SpoolMaxBytes {
+			atomic.AddInt64(&w.stats.Dropped, int64(len(lines)-i))
+			break
+		}
+		bw.Write(line) // error checked by Flush
+		size += int64(len(line))
+		atomic.AddInt64(&w.stats.Spooled, 1)
+	}
+	bw.Flush() // ignore error
+}
+
+// unspool writes the lines of the spool file, and removes it once they are
+// all written.
+func (w *Writer) unspool() error {
+	if w.spoolPath == "" {
+		return nil
+	}
+	f, err := os.Open(w.spoolPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	var batch [][]byte
+	var size int
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			batch = append(batch, line)
+			size += len(line)
+		}
+		if size >= 64<<10 || err != nil && len(batch) > 0 {
+			if _, werr := w.write(batch); werr != nil {
+				return werr
+			}
+			batch, size = batch[:0], 0
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	return os.Remove(w.spoolPath)
+}
+
+// jsonRecord is the JSON encoding of a record.
+type jsonRecord struct {
+	Time     time.Time              `json:"time"`
+	Severity string                 `json:"severity"`
+	Host     string                 `json:"host,omitempty"`
+	Program  string                 `json:"program"`
+	File     string                 `json:"file"`
+	Line     int                    `json:"line"`
+	Func     string                 `json:"func,omitempty"`
+	Message  string                 `json:"message"`
+	Fields   map[string]interface{} `json:"fields,omitempty"`
+}
+
+// encode returns r as a line in the configured format.
+func (w *Writer) encode(r *lg.Record) ([]byte, error) {
+	if w.cfg.Format == Text {
+		line := r.Text
+		if len(line) == 0 || line[len(line)-1] != '\n' {
+			line = append(line[:len(line):len(line)], '\n')
+		}
+		return line, nil
+	}
+	jr := jsonRecord{
+		Time:     r.Time,
+		Severity: r.Severity,
+		Host:     w.host,
+		Program:  lg.ProgramName(),
+		File:     r.File,
+		Line:     r.Line,
+		Func:     r.Func,
+		Message:  r.Message,
+	}
+	if len(r.Fields) > 0 {
+		jr.Fields = make(map[string]interface{}, len(r.Fields))
+		for _, f := range r.Fields {
+			jr.Fields[f.Key] = jsonValue(f.Value)
+		}
+	}
+	line, err := json.Marshal(jr)
+	if err != nil {
+		return nil, err
+	}
+	return append(line, '\n'), nil
+}
+
+// jsonValue returns v as a value which encoding/json handles: strings,
+// booleans and numbers as they are, anything else formatted as a string.
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string, bool, int, int64, uint64:
+		return v
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return fmt.Sprint(v) // JSON has no numbers for these.
+		}
+		return v
+	case nil:
+		return nil
+	default:
+		return fmt.Sprint(v)
+	}
+}
@@ -0,0 +1,19 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package lgnet
+
+import (
+	"os"
+	"syscall"
+)
+
+func init() {
+	lockFile, fileLocks = flockFile, true
+}
+
+// flockFile takes an exclusive flock on f without waiting. A lock left by a
+// process which exited is released by the kernel.
+func flockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+}
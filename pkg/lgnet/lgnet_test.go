@@ -0,0 +1,320 @@
+package lgnet
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thomasf/lg"
+)
+
+func testRecord(msg string) *lg.Record {
+	return &lg.Record{
+		Time:     time.Date(2006, 1, 2, 15, 4, 5, 0, time.UTC),
+		Severity: "WARNING",
+		File:     "edge.go",
+		Line:     7,
+		Message:  msg,
+		Fields:   []lg.Field{lg.KV("n", 1), lg.KV("ok", true)},
+		Text:     []byte("W0102 15:04:05.000000    1234 edge.go:7] " + msg + " n=1 ok=true\n"),
+	}
+}
+
+// acceptLines accepts one connection on ln and sends the lines it reads.
+func acceptLines(ln net.Listener) <-chan string {
+	lines := make(chan string, 100)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		s := bufio.NewScanner(conn)
+		for s.Scan() {
+			lines <- s.Text()
+		}
+	}()
+	return lines
+}
+
+func receive(t *testing.T, lines <-chan string) string {
+	select {
+	case line := <-lines:
+		return line
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a line")
+		return ""
+	}
+}
+
+func TestTCPJSON(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	lines := acceptLines(ln)
+	w, err := New(Config{Network: "tcp", Addr: ln.Addr().String(), Format: JSON})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	w.Emit(testRecord("first"))
+	w.Emit(testRecord("second"))
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"first", "second"} {
+		var got map[string]interface{}
+		if err := json.Unmarshal([]byte(receive(t, lines)), &got); err != nil {
+			t.Fatal(err)
+		}
+		if got["message"] != want || got["severity"] != "WARNING" || got["file"] != "edge.go" || got["line"] != 7.0 ||
+			got["program"] != lg.ProgramName() || got["time"] != "2006-01-02T15:04:05Z" {
+			t.Errorf("unexpected record %v", got)
+		}
+		if fields, _ := got["fields"].(map[string]interface{}); fields["n"] != 1.0 || fields["ok"] != true {
+			t.Errorf("unexpected fields %v", got["fields"])
+		}
+	}
+	if s := w.Stats(); s.Sent != 2 || s.Failures != 0 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+func TestUDPText(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	w, err := New(Config{Network: "udp", Addr: pc.LocalAddr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	r := testRecord("datagram")
+	w.Emit(r)
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1024)
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != string(r.Text) {
+		t.Errorf("got %q, want %q", buf[:n], r.Text)
+	}
+}
+
+// Test that a line too long for a datagram is dropped rather than retried.
+func TestUDPTooLong(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	w, err := New(Config{Network: "udp", Addr: pc.LocalAddr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	w.Emit(testRecord(strings.Repeat("x", 70<<10)))
+	r := testRecord("small")
+	w.Emit(r)
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1024)
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != string(r.Text) {
+		t.Errorf("got %q, want %q", buf[:n], r.Text)
+	}
+	if s := w.Stats(); s.Sent != 1 || s.Dropped != 1 || s.Reconnects != 0 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(nil)
+	certs := srv.TLS.Certificates
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	srv.Close()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: certs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	lines := acceptLines(ln)
+	w, err := New(Config{Network: "tcp", Addr: ln.Addr().String(), TLS: &tls.Config{RootCAs: roots, ServerName: "example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	w.Emit(testRecord("secret"))
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := receive(t, lines)+"\n", string(testRecord("secret").Text); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if _, err := New(Config{Network: "udp", Addr: "127.0.0.1:1", TLS: &tls.Config{}}); err == nil {
+		t.Error("New accepted TLS over UDP")
+	}
+}
+
+// closedAddr returns a TCP address nothing listens on.
+func closedAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+func TestQueueFull(t *testing.T) {
+	w, err := New(Config{Network: "tcp", Addr: closedAddr(t), QueueSize: 2, MinBackoff: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	for _, msg := range []string{"one", "two", "three"} {
+		w.Emit(testRecord(msg))
+	}
+	if err := w.Flush(); err == nil {
+		t.Error("Flush succeeded while disconnected")
+	}
+	if s := w.Stats(); s.Dropped != 1 || s.Failures == 0 || s.Sent != 0 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+	// The lines left unsent by Close are dropped too.
+	w.Close()
+	if s := w.Stats(); s.Dropped != 3 {
+		t.Errorf("dropped %d lines after Close, want 3", s.Dropped)
+	}
+}
+
+// Test that lines are spooled in batches while backing off.
+func TestSpoolBatches(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lgnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	w, err := New(Config{Network: "tcp", Addr: closedAddr(t), SpoolDir: dir, QueueSize: 4, MinBackoff: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for w.Stats().Failures == 0 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	w.Emit(testRecord("one"))
+	w.Flush() // Wait for the writer goroutine.
+	if s := w.Stats(); s.Spooled != 0 {
+		t.Errorf("spooled %d lines before the queue was half full", s.Spooled)
+	}
+	w.Emit(testRecord("two"))
+	w.Flush()
+	if s := w.Stats(); s.Spooled != 2 {
+		t.Errorf("spooled %d lines once the queue was half full, want 2", s.Spooled)
+	}
+}
+
+func TestSpool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lgnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr := closedAddr(t)
+	w, err := New(Config{Network: "tcp", Addr: addr, SpoolDir: dir, MinBackoff: 10 * time.Millisecond, MaxBackoff: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	for _, msg := range []string{"one", "two", "three"} {
+		w.Emit(testRecord(msg))
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for w.Stats().Spooled < 3 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if s := w.Stats(); s.Spooled != 3 {
+		t.Fatalf("spooled %d lines, want 3", s.Spooled)
+	}
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer ln.Close()
+	lines := acceptLines(ln)
+	w.Emit(testRecord("four"))
+	for _, want := range []string{"one", "two", "three", "four"} {
+		if got, text := receive(t, lines)+"\n", string(testRecord(want).Text); got != text {
+			t.Errorf("got %q, want %q", got, text)
+		}
+	}
+	if _, err := os.Stat(w.spoolPath); !os.IsNotExist(err) {
+		t.Errorf("spool file not removed: %v", err)
+	}
+}
+
+// Test that a new Writer sends what an earlier one left in the spool file, and
+// that two Writers cannot share a spool directory.
+func TestSpoolRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lgnet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr := closedAddr(t)
+	w, err := New(Config{Network: "tcp", Addr: addr, SpoolDir: dir, MinBackoff: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other, err := New(Config{Network: "tcp", Addr: addr, SpoolDir: dir}); err == nil {
+		other.Close()
+		if fileLocks {
+			t.Error("two Writers share a spool directory")
+		}
+	}
+	w.Emit(testRecord("before restart"))
+	w.Close()
+	if s := w.Stats(); s.Spooled != 1 {
+		t.Fatalf("spooled %d lines, want 1", s.Spooled)
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer ln.Close()
+	lines := acceptLines(ln)
+	w, err = New(Config{Network: "tcp", Addr: addr, SpoolDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if got, want := receive(t, lines)+"\n", string(testRecord("before restart").Text); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
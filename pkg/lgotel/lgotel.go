@@ -0,0 +1,76 @@
+// Package lgotel correlates lg log lines with OpenTelemetry traces. Once
+// installed, the lines logged with a context carrying a span, through
+// functions such as lg.InfoCtx, end with its trace_id and span_id:
+//
+//	lgotel.Install(lgotel.Options{ErrorEvents: true})
+//	...
+//	lg.ErrorCtx(ctx, "upstream failed")
+//
+// logs
+//
+//	E0102 15:04:05.067890    1234 server.go:42] upstream failed trace_id=4bf92f3577b34da6a3ce929d0e0e4736 span_id=00f067aa0ba902b7
+//
+// Only the OpenTelemetry API is used; the spans are those of whichever
+// TracerProvider the program has configured.
+package lgotel
+
+import (
+	"context"
+
+	"github.com/thomasf/lg"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Options configure the hook returned by Hook.
+type Options struct {
+	// ErrorEvents records the lines of severity ERROR and above as events
+	// of the span, if it is recording, so that they show in tracing UIs.
+	ErrorEvents bool
+}
+
+// Names of the fields and of the span events added by the hook.
+const (
+	TraceIDKey = "trace_id"
+	SpanIDKey  = "span_id"
+
+	EventName   = "log"
+	SeverityKey = "log.severity"
+	MessageKey  = "log.message"
+)
+
+// Install registers the hook returned by Hook with lg.AddContextHook.
+func Install(opts Options) {
+	lg.AddContextHook(Hook(opts))
+}
+
+// Hook returns an lg.ContextHook adding the trace and span IDs of the span
+// carried by the context of a line, if it is valid.
+func Hook(opts Options) lg.ContextHook {
+	return func(ctx context.Context, severity, msg string) []lg.Field {
+		span := trace.SpanFromContext(ctx)
+		sc := span.SpanContext()
+		if !sc.IsValid() {
+			return nil
+		}
+		if opts.ErrorEvents && isError(severity) && span.IsRecording() {
+			span.AddEvent(EventName, trace.WithAttributes(
+				attribute.String(SeverityKey, severity),
+				attribute.String(MessageKey, msg),
+			))
+		}
+		return []lg.Field{
+			lg.KV(TraceIDKey, sc.TraceID().String()),
+			lg.KV(SpanIDKey, sc.SpanID().String()),
+		}
+	}
+}
+
+// isError reports whether severity is ERROR or above.
+func isError(severity string) bool {
+	switch severity {
+	case "ERROR", "CRITICAL", "FATAL":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,67 @@
+package lgotel
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// recordingSpan is a recording span which remembers its events.
+type recordingSpan struct {
+	noop.Span
+	sc     trace.SpanContext
+	events []trace.EventConfig
+}
+
+func (s *recordingSpan) SpanContext() trace.SpanContext { return s.sc }
+
+func (s *recordingSpan) IsRecording() bool { return true }
+
+func (s *recordingSpan) AddEvent(name string, options ...trace.EventOption) {
+	if name == EventName {
+		s.events = append(s.events, trace.NewEventConfig(options...))
+	}
+}
+
+var testSpanContext = trace.NewSpanContext(trace.SpanContextConfig{
+	TraceID:    trace.TraceID{0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6, 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36},
+	SpanID:     trace.SpanID{0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7},
+	TraceFlags: trace.FlagsSampled,
+})
+
+func TestHookFields(t *testing.T) {
+	hook := Hook(Options{})
+	if fields := hook(context.Background(), "INFO", "no span"); fields != nil {
+		t.Errorf("fields without span: %v", fields)
+	}
+	ctx := trace.ContextWithRemoteSpanContext(context.Background(), testSpanContext)
+	fields := hook(ctx, "INFO", "remote")
+	if len(fields) != 2 ||
+		fields[0].Key != TraceIDKey || fields[0].Value != "4bf92f3577b34da6a3ce929d0e0e4736" ||
+		fields[1].Key != SpanIDKey || fields[1].Value != "00f067aa0ba902b7" {
+		t.Errorf("unexpected fields %v", fields)
+	}
+}
+
+func TestHookErrorEvents(t *testing.T) {
+	span := &recordingSpan{sc: testSpanContext}
+	ctx := trace.ContextWithSpan(context.Background(), span)
+	Hook(Options{})(ctx, "ERROR", "not recorded")
+	hook := Hook(Options{ErrorEvents: true})
+	hook(ctx, "WARNING", "below ERROR")
+	hook(ctx, "ERROR", "failed")
+	hook(ctx, "CRITICAL", "down")
+	if len(span.events) != 2 {
+		t.Fatalf("got %d events, want 2", len(span.events))
+	}
+	want := []attribute.KeyValue{
+		attribute.String(SeverityKey, "ERROR"),
+		attribute.String(MessageKey, "failed"),
+	}
+	if attrs := span.events[0].Attributes(); len(attrs) != 2 || attrs[0] != want[0] || attrs[1] != want[1] {
+		t.Errorf("unexpected event attributes %v", attrs)
+	}
+}
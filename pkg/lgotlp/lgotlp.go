@@ -0,0 +1,304 @@
+// Package lgotlp exports lg log lines to an OpenTelemetry collector as OTLP
+// log records, using OTLP/HTTP with the JSON encoding:
+//
+//	exp, err := lgotlp.New(lgotlp.Config{Endpoint: "http://localhost:4318/v1/logs"})
+//	if err != nil {
+//		lg.Fatal(err)
+//	}
+//	lg.AddSink(exp, "INFO")
+//	defer lg.Shutdown(context.Background())
+//
+// Records are batched and sent from a separate goroutine by an
+// lgbatch.Batcher. Failed requests are retried with backoff, and while the
+// collector cannot be reached records are queued up to Config.BufferSize,
+// beyond which the oldest are dropped.
+//
+// Severities map to the OpenTelemetry severity numbers, the file, line and
+// function to the code.filepath, code.lineno and code.function attributes
+// and the fields of a record to attributes of their own, except for trace_id
+// and span_id, as added by package lgotel, which set the trace context of
+// the log record.
+package lgotlp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/thomasf/lg"
+	"github.com/thomasf/lg/pkg/lgbatch"
+)
+
+// Config configures an Exporter. Only Endpoint is required.
+type Config struct {
+	Endpoint string            // The URL of the logs endpoint of the collector, such as http://localhost:4318/v1/logs
+	Headers  map[string]string // Extra HTTP headers, such as for authentication
+	Client   *http.Client      // The client posting the requests, one with a 10 second timeout if nil
+	Resource map[string]string // Resource attributes, service.name defaults to lg.ProgramName()
+
+	BatchSize  int           // The maximum number of records per request, 512 if zero
+	BatchDelay time.Duration // How long a record may wait for its batch to fill, one second if zero
+	BufferSize int           // The maximum number of queued records, 8192 if zero
+	RetryTime  time.Duration // How long a batch is retried before it is dropped, one minute if zero
+	DeadLetter string        // The file which the records of dropped batches are appended to, see lgbatch.Config
+}
+
+// Stats are the counters of an Exporter.
+type Stats struct {
+	Exported int64 // Records accepted by the collector
+	Dropped  int64 // Records dropped because the buffer was full
+	Failed   int64 // Records dropped because they could not be exported
+}
+
+// Exporter is an lg.Sink exporting records to an OTLP collector.
+type Exporter struct {
+	cfg      Config
+	resource []keyValue
+	batcher  *lgbatch.Batcher
+}
+
+// ErrClosed is returned by the methods of an Exporter after Close.
+var ErrClosed = errors.New("lgotlp: exporter closed")
+
+// New returns an Exporter for cfg and starts its export goroutine.
+func New(cfg Config) (*Exporter, error) {
+	if u, err := url.Parse(cfg.Endpoint); err != nil || u.Host == "" {
+		return nil, fmt.Errorf("lgotlp: invalid endpoint %q", cfg.Endpoint)
+	}
+	if cfg.Client == nil {
+		cfg.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	attrs := map[string]string{"service.name": lg.ProgramName()}
+	for k, v := range cfg.Resource {
+		attrs[k] = v
+	}
+	e := &Exporter{cfg: cfg}
+	for k, v := range attrs {
+		e.resource = append(e.resource, keyValue{k, anyValue(v)})
+	}
+	sort.Slice(e.resource, func(i, j int) bool { return e.resource[i].Key < e.resource[j].Key })
+	e.batcher = lgbatch.New(lgbatch.ExporterFunc(e.export), lgbatch.Config{
+		MaxRecords: cfg.BatchSize,
+		MaxLatency: cfg.BatchDelay,
+		QueueSize:  cfg.BufferSize,
+		RetryTime:  cfg.RetryTime,
+		DeadLetter: cfg.DeadLetter,
+	})
+	return e, nil
+}
+
+// Emit is part of the lg.Sink interface. It queues r, dropping the oldest
+// record if the buffer is full.
+func (e *Exporter) Emit(r *lg.Record) error {
+	return closedErr(e.batcher.Emit(r))
+}
+
+// Flush is part of the lg.Sink interface. It tries once to export all queued
+// records and returns the last error. Failed requests keep being retried for
+// up to Config.RetryTime afterwards.
+func (e *Exporter) Flush() error {
+	return closedErr(e.batcher.Flush())
+}
+
+// Close is part of the lg.Sink interface. It exports all queued records and
+// stops the export goroutine.
+func (e *Exporter) Close() error {
+	return closedErr(e.batcher.Close())
+}
+
+// closedErr returns ErrClosed for lgbatch.ErrClosed and err otherwise.
+func closedErr(err error) error {
+	if err == lgbatch.ErrClosed {
+		return ErrClosed
+	}
+	return err
+}
+
+// Stats returns the counters of e.
+func (e *Exporter) Stats() Stats {
+	s := e.batcher.Stats()
+	return Stats{
+		Exported: s.Exported,
+		Dropped:  s.Dropped,
+		Failed:   s.Failed,
+	}
+}
+
+// export posts batch to the collector, once.
+func (e *Exporter) export(batch []*lg.Record) error {
+	body, err := json.Marshal(e.request(batch))
+	if err != nil {
+		return lgbatch.Permanent(err)
+	}
+	req, err := http.NewRequest("POST", e.cfg.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return lgbatch.Permanent(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.cfg.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10)) // ignore error
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusAccepted, http.StatusNoContent:
+		return nil
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		err = fmt.Errorf("lgotlp: collector responded %s", resp.Status)
+		if s, perr := strconv.Atoi(resp.Header.Get("Retry-After")); perr == nil && s > 0 {
+			return lgbatch.RetryAfter(err, time.Duration(s)*time.Second)
+		}
+		return err
+	default:
+		return lgbatch.Permanent(fmt.Errorf("lgotlp: collector responded %s", resp.Status))
+	}
+}
+
+// The OTLP/JSON encoding of an export request, as far as it is used.
+type (
+	exportRequest struct {
+		ResourceLogs []resourceLogs `json:"resourceLogs"`
+	}
+	resourceLogs struct {
+		Resource  resource    `json:"resource"`
+		ScopeLogs []scopeLogs `json:"scopeLogs"`
+	}
+	resource struct {
+		Attributes []keyValue `json:"attributes"`
+	}
+	scopeLogs struct {
+		Scope      scope       `json:"scope"`
+		LogRecords []logRecord `json:"logRecords"`
+	}
+	scope struct {
+		Name string `json:"name"`
+	}
+	logRecord struct {
+		TimeUnixNano         string     `json:"timeUnixNano"`
+		ObservedTimeUnixNano string     `json:"observedTimeUnixNano"`
+		SeverityNumber       int        `json:"severityNumber"`
+		SeverityText         string     `json:"severityText"`
+		Body                 value      `json:"body"`
+		Attributes           []keyValue `json:"attributes,omitempty"`
+		TraceID              string     `json:"traceId,omitempty"`
+		SpanID               string     `json:"spanId,omitempty"`
+	}
+	keyValue struct {
+		Key   string `json:"key"`
+		Value value  `json:"value"`
+	}
+	// value is an AnyValue, holding exactly one of its fields.
+	value map[string]interface{}
+)
+
+// scopeName is the instrumentation scope of the log records.
+const scopeName = "github.com/thomasf/lg"
+
+// severityNumber maps the lg severities to OpenTelemetry severity numbers,
+// following the mapping of the syslog severities.
+var severityNumber = map[string]int{
+	"DEBUG":    5,  // DEBUG
+	"INFO":     9,  // INFO
+	"NOTICE":   10, // INFO2
+	"WARNING":  13, // WARN
+	"ERROR":    17, // ERROR
+	"CRITICAL": 18, // ERROR2
+	"FATAL":    21, // FATAL
+}
+
+// request returns the export request for batch.
+func (e *Exporter) request(batch []*lg.Record) exportRequest {
+	records := make([]logRecord, len(batch))
+	for i, r := range batch {
+		records[i] = logRecordOf(r)
+	}
+	return exportRequest{[]resourceLogs{{
+		Resource:  resource{e.resource},
+		ScopeLogs: []scopeLogs{{Scope: scope{scopeName}, LogRecords: records}},
+	}}}
+}
+
+// logRecordOf returns r as an OTLP log record.
+func logRecordOf(r *lg.Record) logRecord {
+	ts := strconv.FormatInt(r.Time.UnixNano(), 10)
+	lr := logRecord{
+		TimeUnixNano:         ts,
+		ObservedTimeUnixNano: ts,
+		SeverityNumber:       severityNumber[r.Severity],
+		SeverityText:         r.Severity,
+		Body:                 anyValue(r.Message),
+		Attributes: []keyValue{
+			{"code.filepath", anyValue(r.File)},
+			{"code.lineno", anyValue(r.Line)},
+		},
+	}
+	if r.Func != "" {
+		lr.Attributes = append(lr.Attributes, keyValue{"code.function", anyValue(r.Func)})
+	}
+	for _, f := range r.Fields {
+		if s, ok := f.Value.(string); ok {
+			if f.Key == "trace_id" && isHexID(s, 16) {
+				lr.TraceID = s
+				continue
+			}
+			if f.Key == "span_id" && isHexID(s, 8) {
+				lr.SpanID = s
+				continue
+			}
+		}
+		lr.Attributes = append(lr.Attributes, keyValue{f.Key, anyValue(f.Value)})
+	}
+	return lr
+}
+
+// isHexID reports whether s is the hex encoding of an n byte ID.
+func isHexID(s string, n int) bool {
+	if len(s) != 2*n {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// anyValue returns v as an OTLP AnyValue. Values other than strings,
+// booleans and numbers are formatted as strings.
+func anyValue(v interface{}) value {
+	switch v := v.(type) {
+	case string:
+		return value{"stringValue": v}
+	case bool:
+		return value{"boolValue": v}
+	case int:
+		return value{"intValue": strconv.Itoa(v)}
+	case int64:
+		return value{"intValue": strconv.FormatInt(v, 10)}
+	case uint64:
+		return value{"intValue": strconv.FormatUint(v, 10)}
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			// JSON has no numbers for these.
+			return value{"stringValue": strconv.FormatFloat(v, 'g', -1, 64)}
+		}
+		return value{"doubleValue": v}
+	case error:
+		return value{"stringValue": v.Error()}
+	case nil:
+		return value{"stringValue": "nil"}
+	default:
+		return value{"stringValue": fmt.Sprint(v)}
+	}
+}
@@ -0,0 +1,207 @@
+package lgotlp
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/thomasf/lg"
+)
+
+// collector is a fake OTLP/HTTP collector keeping the requests it accepts.
+type collector struct {
+	mu       sync.Mutex
+	requests []exportRequest
+	fail     int // The number of requests to answer with 503 first
+}
+
+func (c *collector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if r.URL.Path != "/v1/logs" || r.Header.Get("Content-Type") != "application/json" {
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+	if c.fail > 0 {
+		c.fail--
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+		return
+	}
+	var req exportRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.requests = append(c.requests, req)
+}
+
+// records returns the log records of all accepted requests.
+func (c *collector) records() []logRecord {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var records []logRecord
+	for _, req := range c.requests {
+		for _, rl := range req.ResourceLogs {
+			for _, sl := range rl.ScopeLogs {
+				records = append(records, sl.LogRecords...)
+			}
+		}
+	}
+	return records
+}
+
+func newTestExporter(t *testing.T, c *collector, cfg Config) *Exporter {
+	srv := httptest.NewServer(c)
+	t.Cleanup(srv.Close)
+	cfg.Endpoint = srv.URL + "/v1/logs"
+	e, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func testRecord(severity, msg string, fields ...lg.Field) *lg.Record {
+	return &lg.Record{
+		Time:     time.Unix(1700000000, 5),
+		Severity: severity,
+		File:     "server.go",
+		Line:     42,
+		Func:     "main.serve",
+		Message:  msg,
+		Fields:   fields,
+	}
+}
+
+func TestExport(t *testing.T) {
+	c := &collector{}
+	e := newTestExporter(t, c, Config{Resource: map[string]string{"service.name": "test", "host.name": "h"}})
+	e.Emit(testRecord("ERROR", "failed",
+		lg.KV("n", 3), lg.KV("ok", true),
+		lg.KV("trace_id", "4bf92f3577b34da6a3ce929d0e0e4736"), lg.KV("span_id", "00f067aa0ba902b7")))
+	e.Emit(testRecord("CRITICAL", "down"))
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.requests) != 1 {
+		t.Fatalf("got %d requests, want 1", len(c.requests))
+	}
+	rl := c.requests[0].ResourceLogs[0]
+	if attrs := rl.Resource.Attributes; len(attrs) != 2 || attrs[1].Key != "service.name" || attrs[1].Value["stringValue"] != "test" {
+		t.Errorf("unexpected resource %v", attrs)
+	}
+	if rl.ScopeLogs[0].Scope.Name != scopeName {
+		t.Errorf("unexpected scope %v", rl.ScopeLogs[0].Scope)
+	}
+	records := c.records()
+	if len(records) != 2 {
+		t.Fatalf("got %d records, want 2", len(records))
+	}
+	r := records[0]
+	if r.TimeUnixNano != "1700000000000000005" || r.SeverityNumber != 17 || r.SeverityText != "ERROR" || r.Body["stringValue"] != "failed" {
+		t.Errorf("unexpected record %+v", r)
+	}
+	if r.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" || r.SpanID != "00f067aa0ba902b7" {
+		t.Errorf("unexpected trace context %q %q", r.TraceID, r.SpanID)
+	}
+	want := map[string]interface{}{
+		"code.filepath": "server.go",
+		"code.lineno":   "42",
+		"code.function": "main.serve",
+		"n":             "3",
+		"ok":            true,
+	}
+	if len(r.Attributes) != len(want) {
+		t.Errorf("unexpected attributes %v", r.Attributes)
+	}
+	for _, kv := range r.Attributes {
+		var got interface{}
+		for _, v := range kv.Value {
+			got = v
+		}
+		if got != want[kv.Key] {
+			t.Errorf("attribute %s is %v, want %v", kv.Key, got, want[kv.Key])
+		}
+	}
+	if records[1].SeverityNumber != 18 {
+		t.Errorf("CRITICAL has severity number %d", records[1].SeverityNumber)
+	}
+	if err := e.Emit(testRecord("INFO", "late")); err != ErrClosed {
+		t.Errorf("Emit after Close returned %v", err)
+	}
+}
+
+func TestBatching(t *testing.T) {
+	c := &collector{}
+	e := newTestExporter(t, c, Config{BatchSize: 2, BatchDelay: 20 * time.Millisecond})
+	defer e.Close()
+	for i := 0; i < 5; i++ {
+		e.Emit(testRecord("INFO", "line"))
+	}
+	// The fifth record is exported once BatchDelay elapses.
+	deadline := time.Now().Add(5 * time.Second)
+	for e.Stats().Exported < 5 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if s := e.Stats(); s.Exported != 5 {
+		t.Fatalf("exported %d records, want 5", s.Exported)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.requests) != 3 {
+		t.Errorf("got %d requests, want 3", len(c.requests))
+	}
+}
+
+func TestRetry(t *testing.T) {
+	c := &collector{fail: 2}
+	e := newTestExporter(t, c, Config{})
+	e.Emit(testRecord("WARNING", "retried"))
+	e.Close()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.requests) != 1 || c.fail != 0 {
+		t.Errorf("record not exported after retries")
+	}
+}
+
+func TestRetryGivesUp(t *testing.T) {
+	c := &collector{fail: 1000}
+	e := newTestExporter(t, c, Config{RetryTime: 50 * time.Millisecond})
+	e.Emit(testRecord("INFO", "lost"))
+	if err := e.Flush(); err == nil {
+		t.Error("Flush succeeded while the collector fails")
+	}
+	e.Close()
+	if s := e.Stats(); s.Failed != 1 || s.Exported != 0 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+func TestBufferFull(t *testing.T) {
+	c := &collector{}
+	e := newTestExporter(t, c, Config{BatchDelay: time.Hour, BufferSize: 2})
+	defer e.Close()
+	for _, msg := range []string{"one", "two", "three"} {
+		e.Emit(testRecord("INFO", msg))
+	}
+	if err := e.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	records := c.records()
+	if len(records) != 2 || records[0].Body["stringValue"] != "two" || records[1].Body["stringValue"] != "three" {
+		t.Errorf("unexpected records %+v", records)
+	}
+	if s := e.Stats(); s.Dropped != 1 || s.Exported != 2 {
+		t.Errorf("unexpected stats %+v", s)
+	}
+}
+
+func TestNewInvalidEndpoint(t *testing.T) {
+	if _, err := New(Config{Endpoint: "localhost"}); err == nil {
+		t.Error("New accepted an endpoint without host")
+	}
+}
@@ -0,0 +1,369 @@
+// Package lgsyslog sends lg log lines to syslog, formatted according to
+// RFC 5424 with the fields of a record as structured data:
+//
+//	w, err := lgsyslog.Dial(lgsyslog.Config{Facility: lgsyslog.Local0})
+//	if err != nil {
+//		lg.Fatal(err)
+//	}
+//	lg.AddSink(w, "INFO")
+//
+// sends lines such as
+//
+//	<134>1 2006-01-02T15:04:05.067890Z host server 1234 - [lg@32473 file="server.go" line="42" request_id="r1"] served
+//
+// to the local syslog daemon, or to a remote one over UDP or TCP.
+package lgsyslog
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thomasf/lg"
+)
+
+// Facility is a syslog facility.
+type Facility int
+
+// The syslog facilities. The kernel facility, zero, is left out: programs
+// cannot log with it, and a zero Config.Facility means User.
+const (
+	_ Facility = iota // kern
+	User
+	Mail
+	Daemon
+	Auth
+	Syslog
+	Lpr
+	News
+	Uucp
+	Cron
+	Authpriv
+	FTP
+	_ // NTP
+	_ // log audit
+	_ // log alert
+	_ // clock daemon
+	Local0
+	Local1
+	Local2
+	Local3
+	Local4
+	Local5
+	Local6
+	Local7
+)
+
+var facilityName = map[string]Facility{
+	"user": User, "mail": Mail, "daemon": Daemon,
+	"auth": Auth, "syslog": Syslog, "lpr": Lpr, "news": News,
+	"uucp": Uucp, "cron": Cron, "authpriv": Authpriv, "ftp": FTP,
+	"local0": Local0, "local1": Local1, "local2": Local2, "local3": Local3,
+	"local4": Local4, "local5": Local5, "local6": Local6, "local7": Local7,
+}
+
+// ParseFacility returns the facility named name, such as "daemon" or
+// "local3".
+func ParseFacility(name string) (Facility, error) {
+	if f, ok := facilityName[strings.ToLower(name)]; ok {
+		return f, nil
+	}
+	return 0, fmt.Errorf("lgsyslog: unknown facility %q", name)
+}
+
+// severityCode maps the lg severities to syslog severities.
+var severityCode = map[string]int{
+	"DEBUG":    7, // debug
+	"INFO":     6, // informational
+	"NOTICE":   5, // notice
+	"WARNING":  4, // warning
+	"ERROR":    3, // error
+	"CRITICAL": 2, // critical
+	"FATAL":    1, // alert
+}
+
+// Config configures a Writer. The zero value sends to the local syslog
+// daemon with the user facility.
+type Config struct {
+	Network  string   // "udp", "tcp", "unixgram" or "unix", or empty for the local syslog daemon
+	Addr     string   // The address of the syslog daemon, unused if Network is empty
+	Facility Facility // The facility of all lines, User if zero
+	AppName  string   // The APP-NAME, lg.ProgramName() if empty
+	Hostname string   // The HOSTNAME, os.Hostname() if empty
+	SDID     string   // The SD-ID of the structured data, DefaultSDID if empty
+}
+
+// DefaultSDID is the SD-ID of the structured data holding the location and
+// fields of a record, under the example enterprise number of RFC 5612.
+const DefaultSDID = "lg@32473"
+
+// Writer is an lg.Sink writing records to syslog. Lines are written as they
+// are emitted, and the connection is reestablished once if writing fails.
+// After a failed reconnection, lines are dropped until a backoff of one
+// second, doubling up to a minute, has passed.
+type Writer struct {
+	cfg    Config
+	header string // The part of the header following the timestamp
+
+	mu      sync.Mutex
+	conn    net.Conn
+	framing framing
+	retryAt time.Time     // When to reconnect after a failure
+	backoff time.Duration // The delay before the next reconnection after a failure
+	closed  bool
+}
+
+// framing is the way messages are delimited on a connection.
+type framing int
+
+const (
+	noFraming      framing = iota // Datagrams hold one message each
+	octetCounting                 // TCP streams, as in RFC 6587
+	newlineFraming                // Local stream sockets, as local daemons expect
+)
+
+// The bounds of the backoff before reconnecting.
+const (
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+)
+
+// dialTimeout connects to a remote syslog daemon. Tests replace it.
+var dialTimeout = net.DialTimeout
+
+// localPaths are the sockets of the local syslog daemon, in order of
+// preference.
+var localPaths = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+// Dial connects to the syslog daemon of cfg and returns a Writer for it.
+func Dial(cfg Config) (*Writer, error) {
+	if cfg.Facility == 0 {
+		cfg.Facility = User
+	}
+	if cfg.Facility < 0 || cfg.Facility > Local7 {
+		return nil, fmt.Errorf("lgsyslog: invalid facility %d", cfg.Facility)
+	}
+	if cfg.AppName == "" {
+		cfg.AppName = lg.ProgramName()
+	}
+	if cfg.Hostname == "" {
+		cfg.Hostname, _ = os.Hostname()
+	}
+	if cfg.SDID == "" {
+		cfg.SDID = DefaultSDID
+	}
+	w := &Writer{
+		cfg: cfg,
+		header: fmt.Sprintf(" %s %s %d - ",
+			headerField(cfg.Hostname, 255), headerField(cfg.AppName, 48), os.Getpid()),
+	}
+	if err := w.dial(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// dial connects to the syslog daemon.
+func (w *Writer) dial() error {
+	if w.cfg.Network != "" {
+		conn, err := dialTimeout(w.cfg.Network, w.cfg.Addr, 10*time.Second)
+		if err != nil {
+			return err
+		}
+		w.conn, w.framing = conn, networkFraming(w.cfg.Network)
+		return nil
+	}
+	for _, network := range []string{"unixgram", "unix"} {
+		for _, path := range localPaths {
+			if conn, err := net.Dial(network, path); err == nil {
+				w.conn, w.framing = conn, networkFraming(network)
+				return nil
+			}
+		}
+	}
+	return errors.New("lgsyslog: no local syslog daemon found")
+}
+
+// networkFraming returns the framing of messages on network.
+func networkFraming(network string) framing {
+	switch {
+	case strings.HasPrefix(network, "tcp"):
+		return octetCounting
+	case network == "unix":
+		return newlineFraming
+	}
+	return noFraming
+}
+
+// Emit is part of the lg.Sink interface. It writes r to syslog.
+// While backing off after a failed reconnection, it drops r and returns an
+// error without connecting.
+func (w *Writer) Emit(r *lg.Record) error {
+	msg := w.format(r)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return errClosed
+	}
+	if w.conn == nil {
+		if err := w.redial(); err != nil {
+			return err
+		}
+	}
+	err := w.write(msg)
+	if err != nil {
+		// The daemon may have been restarted; try once more.
+		w.conn.Close() // ignore error
+		w.conn = nil
+		if err = w.redial(); err != nil {
+			return err
+		}
+		err = w.write(msg)
+	}
+	return err
+}
+
+// redial reconnects to the syslog daemon unless it is backing off after a
+// failure.
+// w.mu is held.
+func (w *Writer) redial() error {
+	now := time.Now()
+	if now.Before(w.retryAt) {
+		return errUnavailable
+	}
+	if err := w.dial(); err != nil {
+		if w.backoff < minBackoff {
+			w.backoff = minBackoff
+		}
+		w.retryAt = now.Add(w.backoff)
+		if w.backoff *= 2; w.backoff > maxBackoff {
+			w.backoff = maxBackoff
+		}
+		return err
+	}
+	w.backoff = 0
+	return nil
+}
+
+var (
+	errClosed      = errors.New("lgsyslog: writer closed")
+	errUnavailable = errors.New("lgsyslog: syslog daemon unavailable, dropping line")
+)
+
+// writeTimeout bounds how long a stalled syslog daemon blocks logging.
+const writeTimeout = 10 * time.Second
+
+// write writes msg, framed according to w.framing.
+// w.mu is held.
+func (w *Writer) write(msg []byte) error {
+	switch w.framing {
+	case octetCounting:
+		msg = append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+	case newlineFraming:
+		msg = append(msg, '\n')
+	}
+	w.conn.SetWriteDeadline(time.Now().Add(writeTimeout)) // ignore error
+	_, err := w.conn.Write(msg)
+	return err
+}
+
+// Flush is part of the lg.Sink interface. Lines are not buffered, so it does
+// nothing.
+func (w *Writer) Flush() error {
+	return nil
+}
+
+// Close is part of the lg.Sink interface. It closes the connection.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return errClosed
+	}
+	w.closed = true
+	if w.conn == nil {
+		return nil
+	}
+	err := w.conn.Close()
+	w.conn = nil
+	return err
+}
+
+// format returns r as an RFC 5424 message.
+func (w *Writer) format(r *lg.Record) []byte {
+	sev, ok := severityCode[r.Severity]
+	if !ok {
+		sev = severityCode["INFO"]
+	}
+	b := make([]byte, 0, 128+len(r.Message))
+	b = append(b, '<')
+	b = strconv.AppendInt(b, int64(int(w.cfg.Facility)*8+sev), 10)
+	b = append(b, ">1 "...)
+	b = r.Time.UTC().AppendFormat(b, "2006-01-02T15:04:05.000000Z")
+	b = append(b, w.header...)
+	b = append(b, '[')
+	b = append(b, w.cfg.SDID...)
+	b = appendParam(b, "file", r.File)
+	b = appendParam(b, "line", strconv.Itoa(r.Line))
+	if r.Func != "" {
+		b = appendParam(b, "func", r.Func)
+	}
+	for _, f := range r.Fields {
+		b = appendParam(b, f.Key, fmt.Sprint(f.Value))
+	}
+	b = append(b, "] "...)
+	b = append(b, r.Message...)
+	return b
+}
+
+// appendParam appends the SD-PARAM name="value" to b, replacing the
+// characters not allowed in a PARAM-NAME by underscores and escaping those
+// which must be in a PARAM-VALUE.
+func appendParam(b []byte, name, value string) []byte {
+	b = append(b, ' ')
+	if name == "" {
+		name = "_"
+	}
+	if len(name) > 32 {
+		name = name[:32]
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c <= ' ' || c >= 0x7f || c == '=' || c == ']' || c == '"' {
+			c = '_'
+		}
+		b = append(b, c)
+	}
+	b = append(b, '=', '"')
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case '"', '\\', ']':
+			b = append(b, '\\', c)
+		default:
+			b = append(b, c)
+		}
+	}
+	return append(b, '"')
+}
+
+// headerField returns s for use as a header field of at most n printable
+// ASCII characters, or the nil value "-" if it is empty.
+func headerField(s string, n int) string {
+	if s == "" {
+		return "-"
+	}
+	if len(s) > n {
+		s = s[:n]
+	}
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r >= 0x7f {
+			return '_'
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,230 @@
+package lgsyslog
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thomasf/lg"
+)
+
+var testConfig = Config{Facility: Local0, AppName: "app", Hostname: "host"}
+
+func testRecord() *lg.Record {
+	return &lg.Record{
+		Time:     time.Date(2006, 1, 2, 15, 4, 5, 67890000, time.UTC),
+		Severity: "ERROR",
+		File:     "server.go",
+		Line:     42,
+		Message:  "failed",
+		Fields:   []lg.Field{lg.KV("request_id", "r1"), lg.KV("bad key", `a "b" [c]`)},
+	}
+}
+
+func testMessage() string {
+	return fmt.Sprintf(`<131>1 2006-01-02T15:04:05.067890Z host app %d - [lg@32473 file="server.go" line="42" request_id="r1" bad_key="a \"b\" [c\]"] failed`, os.Getpid())
+}
+
+func TestFormat(t *testing.T) {
+	w := &Writer{cfg: testConfig, header: fmt.Sprintf(" host app %d - ", os.Getpid())}
+	w.cfg.SDID = DefaultSDID
+	if got, want := string(w.format(testRecord())), testMessage(); got != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+}
+
+func TestUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	cfg := testConfig
+	cfg.Network, cfg.Addr = "udp", pc.LocalAddr().String()
+	testPacket(t, pc, cfg)
+}
+
+func TestUnixgram(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lgsyslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "log")
+	pc, err := net.ListenPacket("unixgram", path)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer pc.Close()
+	defer func(previous []string) { localPaths = previous }(localPaths)
+	localPaths = []string{filepath.Join(dir, "missing"), path}
+	testPacket(t, pc, testConfig)
+}
+
+// testPacket writes a record to the packet listener pc with cfg.
+func testPacket(t *testing.T, pc net.PacketConn, cfg Config) {
+	w, err := Dial(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if err := w.Emit(testRecord()); err != nil {
+		t.Fatal(err)
+	}
+	pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1024)
+	n, _, err := pc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(buf[:n]), testMessage(); got != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+}
+
+func TestTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	received := make(chan string, 2)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			// Octet counting: the length, a space and the message.
+			size, err := r.ReadString(' ')
+			if err != nil {
+				return
+			}
+			n, _ := strconv.Atoi(strings.TrimSpace(size))
+			msg := make([]byte, n)
+			if _, err := io.ReadFull(r, msg); err != nil {
+				return
+			}
+			received <- string(msg)
+		}
+	}()
+	cfg := testConfig
+	cfg.Network, cfg.Addr = "tcp", ln.Addr().String()
+	w, err := Dial(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	for i := 0; i < 2; i++ {
+		if err := w.Emit(testRecord()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case got := <-received:
+			if want := testMessage(); got != want {
+				t.Errorf("got  %s\nwant %s", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for a message")
+		}
+	}
+}
+
+func TestUnixStream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lgsyslog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "log")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer ln.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		// Local daemons read messages terminated by a newline.
+		msg, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil {
+			return
+		}
+		received <- msg
+	}()
+	cfg := testConfig
+	cfg.Network, cfg.Addr = "unix", path
+	w, err := Dial(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	if err := w.Emit(testRecord()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-received:
+		if want := testMessage() + "\n"; got != want {
+			t.Errorf("got  %q\nwant %q", got, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a message")
+	}
+}
+
+func TestRedialBackoff(t *testing.T) {
+	dials := 0
+	defer func(previous func(string, string, time.Duration) (net.Conn, error)) { dialTimeout = previous }(dialTimeout)
+	dialTimeout = func(network, addr string, timeout time.Duration) (net.Conn, error) {
+		dials++
+		return nil, errors.New("unreachable")
+	}
+	cfg := testConfig
+	cfg.Network, cfg.Addr = "tcp", "syslog.invalid:514"
+	w := &Writer{cfg: cfg}
+	for i := 0; i < 3; i++ {
+		if err := w.Emit(testRecord()); err == nil {
+			t.Fatal("Emit succeeded without a connection")
+		}
+	}
+	if dials != 1 {
+		t.Errorf("expected one dial while backing off, got %d", dials)
+	}
+	if w.backoff != 2*minBackoff {
+		t.Errorf("expected the next backoff to be %v, got %v", 2*minBackoff, w.backoff)
+	}
+	w.retryAt = time.Time{}
+	w.Emit(testRecord())
+	if dials != 2 {
+		t.Errorf("expected a dial after the backoff, got %d dials", dials)
+	}
+}
+
+func TestParseFacility(t *testing.T) {
+	if f, err := ParseFacility("LOCAL3"); err != nil || f != Local3 {
+		t.Errorf("ParseFacility(LOCAL3) = %d, %v", f, err)
+	}
+	if _, err := ParseFacility("kern"); err == nil {
+		t.Error("ParseFacility accepted kern")
+	}
+	if _, err := ParseFacility("local8"); err == nil {
+		t.Error("ParseFacility accepted local8")
+	}
+}
@@ -1,6 +1,8 @@
 package prometheus
 
 import (
+	"sync/atomic"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/thomasf/lg"
 )
@@ -26,4 +28,39 @@ func init() {
 	}, func() float64 {
 		return float64(lg.Stats.Error.Lines())
 	}))
+
+	prometheus.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Name: "lg_debug_lines",
+		Help: "Number of lg debug lines logged",
+	}, func() float64 {
+		return float64(lg.Stats.Debug.Lines())
+	}))
+
+	prometheus.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Name: "lg_notice_lines",
+		Help: "Number of lg notice lines logged",
+	}, func() float64 {
+		return float64(lg.Stats.Notice.Lines())
+	}))
+
+	prometheus.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Name: "lg_critical_lines",
+		Help: "Number of lg critical lines logged",
+	}, func() float64 {
+		return float64(lg.Stats.Critical.Lines())
+	}))
+
+	prometheus.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Name: "lg_file_errors",
+		Help: "Number of errors creating or writing lg log files",
+	}, func() float64 {
+		return float64(atomic.LoadInt64(&lg.Stats.FileErrors))
+	}))
+
+	prometheus.MustRegister(prometheus.NewCounterFunc(prometheus.CounterOpts{
+		Name: "lg_sink_errors",
+		Help: "Number of errors returned by lg sinks",
+	}, func() float64 {
+		return float64(atomic.LoadInt64(&lg.Stats.SinkErrors))
+	}))
 }